@@ -7,13 +7,13 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"text/template"
 
 	flag "github.com/spf13/pflag"
 )
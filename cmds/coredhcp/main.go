@@ -7,9 +7,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/insei/coredhcp/config"
@@ -25,6 +29,7 @@ import (
 	pl_netmask "github.com/insei/coredhcp/plugins/netmask"
 	pl_prefix "github.com/insei/coredhcp/plugins/prefix"
 	pl_range "github.com/insei/coredhcp/plugins/range"
+	pl_range6 "github.com/insei/coredhcp/plugins/range6"
 	pl_router "github.com/insei/coredhcp/plugins/router"
 	pl_searchdomains "github.com/insei/coredhcp/plugins/searchdomains"
 	pl_serverid "github.com/insei/coredhcp/plugins/serverid"
@@ -39,8 +44,9 @@ var (
 	flagLogFile     = flag.StringP("logfile", "l", "", "Name of the log file to append to. Default: stdout/stderr only")
 	flagLogNoStdout = flag.BoolP("nostdout", "N", false, "Disable logging to stdout/stderr")
 	flagLogLevel    = flag.StringP("loglevel", "L", "info", fmt.Sprintf("Log level. One of %v", getLogLevels()))
-	flagConfig      = flag.StringP("conf", "c", "default-server.config.yml", "Use this configuration file instead of the default location")
+	flagConfig      = flag.StringSliceP("conf", "c", []string{"default-server.config.yml"}, "Use these configuration files, or the <server-name>.config.yml files of these directories, instead of the default location. Each file starts a server")
 	flagPlugins     = flag.BoolP("plugins", "P", false, "list plugins")
+	flagShutdown    = flag.DurationP("shutdown-timeout", "t", 10*time.Second, "How long to wait for requests being handled when shutting down")
 )
 
 var logLevels = map[string]func(*logrus.Logger){
@@ -69,6 +75,7 @@ var desiredPlugins = []*plugins.Plugin{
 	&pl_netmask.Plugin,
 	&pl_prefix.Plugin,
 	&pl_range.Plugin,
+	&pl_range6.Plugin,
 	&pl_router.Plugin,
 	&pl_searchdomains.Plugin,
 	&pl_serverid.Plugin,
@@ -76,6 +83,118 @@ var desiredPlugins = []*plugins.Plugin{
 	&pl_staticroute.Plugin,
 }
 
+// instance is a server started from a configuration file
+type instance struct {
+	path   string
+	parser *config.Parser
+	srv    *server.Servers
+}
+
+// stopped reports the end of the execution of a server
+type stopped struct {
+	name string
+	inst *instance
+	err  error
+}
+
+// start starts a server from a configuration file, reporting the end of its
+// execution to done
+func start(log logrus.FieldLogger, path string, done chan<- stopped) (string, *instance, error) {
+	parser := config.NewParser(log)
+	conf, err := parser.Parse(path)
+	if err != nil {
+		return "", nil, err
+	}
+	srv, err := server.Start(logger.GetLogger(conf.Name), conf)
+	if err != nil {
+		return "", nil, err
+	}
+	inst := &instance{path: path, parser: parser, srv: srv}
+	go func() {
+		done <- stopped{name: conf.Name, inst: inst, err: srv.Wait()}
+	}()
+	return conf.Name, inst, nil
+}
+
+// reload re-reads the configuration file of a server and applies it. The
+// current configuration is kept if the new one is invalid
+func (inst *instance) reload(log logrus.FieldLogger) {
+	log.Infof("Reloading configuration from %s", inst.path)
+	conf, err := inst.parser.Parse(inst.path)
+	if err != nil {
+		log.Errorf("Failed to load configuration, keeping the current one: %v", err)
+		return
+	}
+	if err := inst.srv.Reload(conf); err != nil {
+		log.Errorf("Failed to apply configuration, keeping the current one: %v", err)
+	}
+}
+
+// shutdown gracefully stops a server
+func (inst *instance) shutdown(log logrus.FieldLogger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *flagShutdown)
+	defer cancel()
+	if err := inst.srv.Shutdown(ctx); err != nil {
+		log.Errorf("Unclean shutdown of %s: %v", inst.path, err)
+		return err
+	}
+	return nil
+}
+
+// shutdownAll gracefully stops all the servers at once, and reports whether
+// they all stopped cleanly
+func shutdownAll(log logrus.FieldLogger, servers map[string]*instance) bool {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	clean := true
+	for _, inst := range servers {
+		wg.Add(1)
+		go func(inst *instance) {
+			defer wg.Done()
+			if err := inst.shutdown(log); err != nil {
+				mu.Lock()
+				clean = false
+				mu.Unlock()
+			}
+		}(inst)
+	}
+	wg.Wait()
+	return clean
+}
+
+// reload reloads the servers whose configuration files are still there,
+// starts the servers of new files and stops the ones whose files are gone
+func reload(log logrus.FieldLogger, servers map[string]*instance, done chan<- stopped) {
+	files, err := config.Files(*flagConfig)
+	if err != nil {
+		log.Errorf("Failed to list configuration files, keeping the current servers: %v", err)
+		return
+	}
+	current := make(map[string]bool, len(files))
+	for _, path := range files {
+		name, _ := config.ServerName(path)
+		current[name] = true
+		if inst, ok := servers[name]; ok {
+			inst.path = path
+			inst.reload(log)
+			continue
+		}
+		log.Infof("Starting server %s from %s", name, path)
+		if _, inst, err := start(log, path, done); err != nil {
+			log.Errorf("Failed to start server %s: %v", name, err)
+		} else {
+			servers[name] = inst
+		}
+	}
+	for name, inst := range servers {
+		if !current[name] {
+			log.Infof("Configuration of server %s removed, shutting it down", name)
+			delete(servers, name)
+			inst.shutdown(log)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -109,21 +228,52 @@ func main() {
 		}
 	}
 
-	// parse config
-	parser := config.NewParser(log)
-	config, err := parser.Parse(*flagConfig)
+	// start a server per configuration file
+	files, err := config.Files(*flagConfig)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	serverLogger := logger.GetLogger(config.Name)
+	servers := make(map[string]*instance, len(files))
+	done := make(chan stopped, len(files))
+	for _, path := range files {
+		name, inst, err := start(log, path, done)
+		if err != nil {
+			// Stop the servers already started, for their plugins to
+			// close their lease stores
+			log.Errorf("Failed to start server from %s: %v", path, err)
+			shutdownAll(log, servers)
+			os.Exit(1)
+		}
+		servers[name] = inst
+	}
 
-	// start server
-	srv, err := server.Start(serverLogger, config)
-	if err != nil {
-		log.Fatal(err)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	failed := false
+run:
+	for len(servers) > 0 {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reload(log, servers, done)
+				continue
+			}
+			log.Infof("Received %s, shutting down", sig)
+			break run
+		case s := <-done:
+			if servers[s.name] != s.inst {
+				// Shut down by a reload
+				continue
+			}
+			// The other servers keep running
+			log.Errorf("Server %s stopped: %v", s.name, s.err)
+			delete(servers, s.name)
+			s.inst.shutdown(log)
+			failed = true
+		}
 	}
-	if err := srv.Wait(); err != nil {
-		log.Print(err)
+
+	if !shutdownAll(log, servers) || failed {
+		os.Exit(1)
 	}
-	time.Sleep(time.Second)
 }
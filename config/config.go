@@ -5,11 +5,13 @@
 package config
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
@@ -39,7 +41,128 @@ func New() *Config {
 // DHCPv6 server or the DHCPv4 server.
 type ServerConfig struct {
 	Addresses []net.UDPAddr
+	// Listeners are the listen entries with their own plugins. Requests
+	// received on their addresses are only handled by those plugins, instead
+	// of the server-wide, subnet, link and class plugins. Their addresses are
+	// also in Addresses
+	Listeners []ListenerConfig
 	Plugins   []PluginConfig
+	Workers   WorkerConfig
+	// Subnets have their own plugins, run after the server-wide ones for the
+	// requests from the subnet. Only supported for DHCPv4
+	Subnets []SubnetConfig
+	// Links have their own plugins, run after the server-wide ones for the
+	// requests from the link. Only supported for DHCPv6
+	Links []LinkConfig
+	// Classes have their own plugins, run after the server-wide, subnet and
+	// link ones for the requests in the class, in configuration order
+	Classes []ClassConfig
+	// Batch is the number of datagrams each listener reads at once, batching
+	// is disabled if it is 1 or less
+	Batch int
+	// Timeout is how long a request may be handled before its response is
+	// dropped, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// DefaultTimeout is the default time limit to handle a request
+const DefaultTimeout = 5 * time.Second
+
+// DropPolicy selects the datagram dropped when a listener's queue is full
+type DropPolicy int
+
+const (
+	// DropNewest drops the datagram just received
+	DropNewest DropPolicy = iota
+	// DropOldest drops the datagram that has been waiting the longest, which
+	// the client is the most likely to have retransmitted already
+	DropOldest
+)
+
+// Default sizes of the worker pools
+const (
+	DefaultWorkers = 64
+	DefaultQueue   = 256
+)
+
+// WorkerConfig holds the settings of the worker pool handling the datagrams
+// received on each listener. Zero values select the defaults
+type WorkerConfig struct {
+	// Workers is the number of datagrams handled concurrently
+	Workers int
+	// Queue is the number of datagrams waiting for a worker, past which they
+	// are dropped
+	Queue int
+	Drop  DropPolicy
+}
+
+// parseDropPolicy parses the name of a drop policy
+func parseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "", "newest":
+		return DropNewest, nil
+	case "oldest":
+		return DropOldest, nil
+	default:
+		return 0, fmt.Errorf("unknown drop policy %q, expected newest or oldest", s)
+	}
+}
+
+// ListenerConfig holds the configuration of a listen entry with its own
+// plugins
+type ListenerConfig struct {
+	// Addresses has several addresses when a multicast address without an
+	// interface is expanded to all the interfaces
+	Addresses []net.UDPAddr
+	Plugins   []PluginConfig
+}
+
+// SubnetConfig holds the configuration of a subnet
+type SubnetConfig struct {
+	Net     net.IPNet
+	Plugins []PluginConfig
+}
+
+// LinkConfig holds the configuration of a DHCPv6 link. Requests are matched to
+// it by prefix, by interface-id, or both
+type LinkConfig struct {
+	// Net is matched against the link-address of the relay closest to the
+	// client, or the addresses of the interface direct requests are received
+	// on. It is unset (nil IP) if the link is only matched by interface-id
+	Net net.IPNet
+	// InterfaceID is matched against the interface-id option of the relay
+	// closest to the client, if not empty
+	InterfaceID string
+	Plugins     []PluginConfig
+}
+
+// ClassConfig holds the configuration of a client class
+type ClassConfig struct {
+	Name    string
+	Match   ClassMatch
+	Plugins []PluginConfig
+}
+
+// ClassMatch holds the criteria a request must all meet to be in a class.
+// Unset criteria are ignored
+type ClassMatch struct {
+	// VendorClass is a prefix of the vendor class identifier (option 60) of
+	// DHCPv4 requests, or of one of the vendor class data (option 16) of
+	// DHCPv6 requests
+	VendorClass string
+	// UserClass is one of the user classes of the request (option 77 for
+	// DHCPv4, option 15 for DHCPv6)
+	UserClass string
+	// OUI is the first 3 bytes of the hardware address of the client
+	OUI []byte
+	// HardwareType is the hardware type of the client, 0 if unset
+	HardwareType uint16
+	// Interface is the name of the interface the request was received on
+	Interface string
+	// CircuitID is the circuit-id sub-option of the relay agent information
+	// option (option 82) of DHCPv4 requests, or the interface-id option of
+	// the relay closest to the client for DHCPv6 requests
+	CircuitID string
 }
 
 // PluginConfig holds the configuration of a plugin
@@ -48,6 +171,15 @@ type PluginConfig struct {
 	Args []string
 }
 
+// parseOUI parses an OUI of the form 00:11:22, 00-11-22 or 001122
+func parseOUI(s string) ([]byte, error) {
+	oui, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(s))
+	if err != nil || len(oui) != 3 {
+		return nil, fmt.Errorf("invalid OUI %q", s)
+	}
+	return oui, nil
+}
+
 func protoVersionCheck(v protocolVersion) error {
 	if v != protocolV6 && v != protocolV4 {
 		return fmt.Errorf("invalid protocol version: %d", v)
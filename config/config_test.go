@@ -4,7 +4,16 @@
 
 package config
 
-import "testing"
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
 
 func TestSplitHostPort(t *testing.T) {
 	testcases := []struct {
@@ -50,3 +59,115 @@ func TestSplitHostPort(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOUI(t *testing.T) {
+	for _, s := range []string{"00:1a:2B", "00-1a-2b", "001a2b"} {
+		oui, err := parseOUI(s)
+		if err != nil || !bytes.Equal(oui, []byte{0x00, 0x1a, 0x2b}) {
+			t.Errorf("%s => %x, %v expected 001a2b", s, oui, err)
+		}
+	}
+	for _, s := range []string{"", "00:1a", "00:1a:2b:3c", "00:1a:zz"} {
+		if _, err := parseOUI(s); err == nil {
+			t.Errorf("%s should error", s)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.config.yml")
+	for conf, expected := range map[string]time.Duration{
+		"server4:\n  plugins:\n    - server_id: 10.0.0.1\n":                0,
+		"server4:\n  timeout: 2s\n  plugins:\n    - server_id: 10.0.0.1\n": 2 * time.Second,
+	} {
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewParser(logrus.New()).Parse(path)
+		if err != nil {
+			t.Errorf("%q: %v", conf, err)
+			continue
+		}
+		if c.Server4.Timeout != expected {
+			t.Errorf("%q => timeout %v expected %v", conf, c.Server4.Timeout, expected)
+		}
+	}
+	for _, timeout := range []string{"5", "1.5", "-1s", "soon"} {
+		conf := "server4:\n  timeout: " + timeout + "\n  plugins:\n    - server_id: 10.0.0.1\n"
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewParser(logrus.New()).Parse(path); err == nil {
+			t.Errorf("timeout %s should error", timeout)
+		}
+	}
+}
+
+func TestParseListenPlugins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.config.yml")
+	conf := `
+server4:
+  listen:
+    - "127.0.0.1:67"
+    - address: "127.0.0.2:67"
+      plugins:
+        - server_id: 127.0.0.2
+  plugins:
+    - server_id: 127.0.0.1
+`
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewParser(logrus.New()).Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Server4.Addresses) != 2 {
+		t.Errorf("Addresses %v, expected both listen entries", c.Server4.Addresses)
+	}
+	if len(c.Server4.Listeners) != 1 || len(c.Server4.Listeners[0].Addresses) != 1 ||
+		c.Server4.Listeners[0].Addresses[0].String() != "127.0.0.2:67" || len(c.Server4.Listeners[0].Plugins) != 1 {
+		t.Errorf("Listeners %+v, expected 127.0.0.2:67 with its plugin", c.Server4.Listeners)
+	}
+
+	// Listening twice on an address with its own plugins is ambiguous
+	conf = strings.Replace(conf, "127.0.0.1:67", "127.0.0.2:67", 1)
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewParser(logrus.New()).Parse(path); err == nil {
+		t.Error("Duplicate listen address accepted")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"lab.config.yml", "mgmt.config.yml", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(t.TempDir(), "other.config.yml")
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Files([]string{dir, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "lab.config.yml"), filepath.Join(dir, "mgmt.config.yml"), other}
+	if strings.Join(files, " ") != strings.Join(expected, " ") {
+		t.Errorf("Files %v, expected %v", files, expected)
+	}
+
+	if _, err := Files([]string{dir, filepath.Join(dir, "lab.config.yml")}); err == nil {
+		t.Error("Several configurations of a server accepted")
+	}
+	if _, err := Files([]string{filepath.Join(dir, "notes.txt")}); err == nil {
+		t.Error("Configuration file without a server name accepted")
+	}
+	if _, err := Files([]string{t.TempDir()}); err == nil {
+		t.Error("Directory without configuration accepted")
+	}
+}
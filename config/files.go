@@ -0,0 +1,64 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configSuffix ends the name of configuration files, which start with the
+// name of the server they configure
+const configSuffix = ".config.yml"
+
+// ServerName returns the name of the server configured by a file, of the form
+// <server-name>.config.yml
+func ServerName(path string) (string, error) {
+	filename := filepath.Base(path)
+	if !strings.HasSuffix(filename, configSuffix) || len(filename) == len(configSuffix) {
+		return "", fmt.Errorf("incorrect config name %s, correct: <server-name>%s", path, configSuffix)
+	}
+	return strings.TrimSuffix(filename, configSuffix), nil
+}
+
+// Files returns the configuration files to start servers from: the given
+// files, and the <server-name>.config.yml files of the given directories. It
+// fails if several files configure servers with the same name
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*"+configSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no *%s file in %s", configSuffix, path)
+		}
+		files = append(files, matches...)
+	}
+
+	names := make(map[string]string, len(files))
+	for _, file := range files {
+		name, err := ServerName(file)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("%s and %s both configure server %s", other, file, name)
+		}
+		names[name] = file
+	}
+	return files, nil
+}
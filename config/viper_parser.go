@@ -7,8 +7,7 @@ package config
 import (
 	"fmt"
 	"net"
-	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
@@ -34,11 +33,13 @@ func NewParser(logger logrus.FieldLogger) *Parser {
 // Parse reads a configuration file and returns a Config object, or an error if
 // any.
 func (p *Parser) Parse(path string) (*Config, error) {
-	filename := filepath.Base(path)
-	if !strings.HasSuffix(filename, ".config.yml") {
-		return nil, fmt.Errorf("incorrect config name, correct: <server-name>.config.yml")
+	name, err := ServerName(path)
+	if err != nil {
+		return nil, err
 	}
-	p.config.Name = filename[:len(filename)-len(".config.yml")]
+	// Start afresh, the parser may be used again to reload the configuration
+	p.config = New()
+	p.config.Name = name
 	p.logger = p.logger.WithField("server", p.config.Name)
 
 	p.logger.Print("Loading configuration")
@@ -60,50 +61,97 @@ func (p *Parser) Parse(path string) (*Config, error) {
 	return p.config, nil
 }
 
-func (p *Parser) parseListen(ver protocolVersion) ([]net.UDPAddr, error) {
+func (p *Parser) parseListen(ver protocolVersion) ([]net.UDPAddr, []ListenerConfig, error) {
 	if err := protoVersionCheck(ver); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	listen := p.v.Get(fmt.Sprintf("server%d.listen", ver))
 
 	// Provide an emulation of the old keyword "interface" to avoid breaking config files
 	if iface := p.v.Get(fmt.Sprintf("server%d.interface", ver)); iface != nil && listen != nil {
-		return nil, ConfigErrorFromString("interface is a deprecated alias for listen, " +
+		return nil, nil, ConfigErrorFromString("interface is a deprecated alias for listen, " +
 			"both cannot be used at the same time. Choose one and remove the other.")
 	} else if iface != nil {
 		listen = "%" + cast.ToString(iface)
 	}
 
 	if listen == nil {
-		return defaultListen(ver)
+		addrs, err := defaultListen(ver)
+		return addrs, nil, err
 	}
 
-	addrs, err := cast.ToStringSliceE(listen)
+	entries, err := cast.ToSliceE(listen)
 	if err != nil {
-		addrs = []string{cast.ToString(listen)}
-	}
-
-	listeners := []net.UDPAddr{}
-	for _, a := range addrs {
-		l, err := getListenAddress(a, ver)
+		strs, err := cast.ToStringSliceE(listen)
 		if err != nil {
-			return nil, err
+			strs = []string{cast.ToString(listen)}
+		}
+		for _, s := range strs {
+			entries = append(entries, s)
 		}
+	}
 
-		if l.Zone == "" && (l.IP.IsLinkLocalMulticast() || l.IP.IsInterfaceLocalMulticast()) {
-			// link-local multicast specified without interface gets expanded to listen on all interfaces
-			expanded, err := expandLLMulticast(l)
+	var (
+		addrs     []net.UDPAddr
+		listeners []ListenerConfig
+	)
+	for idx, entry := range entries {
+		conf, err := cast.ToStringMapE(entry)
+		if err != nil {
+			// A plain address, using the server-wide plugins
+			expanded, err := listenAddresses(cast.ToString(entry), ver)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			listeners = append(listeners, expanded...)
+			addrs = append(addrs, expanded...)
 			continue
 		}
+		expanded, err := listenAddresses(cast.ToString(conf["address"]), ver)
+		if err != nil {
+			return nil, nil, err
+		}
+		pluginList := cast.ToSlice(conf["plugins"])
+		if pluginList == nil {
+			return nil, nil, ConfigErrorFromString("dhcpv%d: listen entry #%d: invalid plugins section, not a list or no plugin specified", ver, idx)
+		}
+		plugins, err := parsePlugins(pluginList)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, plugin := range plugins {
+			p.logger.Printf("DHCPv%d: found plugin `%s` for listen entry #%d with %d args: %v", ver, plugin.Name, idx, len(plugin.Args), plugin.Args)
+		}
+		addrs = append(addrs, expanded...)
+		listeners = append(listeners, ListenerConfig{Addresses: expanded, Plugins: plugins})
+	}
+	// The plugins of a request must not depend on which entry listened first
+	seen := make(map[string]int, len(addrs))
+	for _, addr := range addrs {
+		seen[addr.String()]++
+	}
+	for idx, l := range listeners {
+		for _, addr := range l.Addresses {
+			if seen[addr.String()] > 1 {
+				return nil, nil, ConfigErrorFromString("dhcpv%d: listen entry #%d: %s is listened on several times", ver, idx, &addr)
+			}
+		}
+	}
+	return addrs, listeners, nil
+}
 
-		listeners = append(listeners, *l)
+// listenAddresses parses a listen address, expanding link-local multicast
+// addresses without an interface to all the interfaces
+func listenAddresses(a string, ver protocolVersion) ([]net.UDPAddr, error) {
+	l, err := getListenAddress(a, ver)
+	if err != nil {
+		return nil, err
+	}
+	if l.Zone == "" && (l.IP.IsLinkLocalMulticast() || l.IP.IsInterfaceLocalMulticast()) {
+		// link-local multicast specified without interface gets expanded to listen on all interfaces
+		return expandLLMulticast(l)
 	}
-	return listeners, nil
+	return []net.UDPAddr{*l}, nil
 }
 
 func (p *Parser) getPlugins(ver protocolVersion) ([]PluginConfig, error) {
@@ -117,6 +165,165 @@ func (p *Parser) getPlugins(ver protocolVersion) ([]PluginConfig, error) {
 	return parsePlugins(pluginList)
 }
 
+func (p *Parser) parseSubnets(ver protocolVersion) ([]SubnetConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	list := p.v.Get(fmt.Sprintf("server%d.subnets", ver))
+	if list == nil {
+		return nil, nil
+	}
+	if ver != protocolV4 {
+		return nil, ConfigErrorFromString("dhcpv%d: subnets are only supported for DHCPv4", ver)
+	}
+	items, err := cast.ToSliceE(list)
+	if err != nil {
+		return nil, ConfigErrorFromString("dhcpv%d: invalid subnets section, not a list", ver)
+	}
+	subnets := make([]SubnetConfig, 0, len(items))
+	for idx, item := range items {
+		conf := cast.ToStringMap(item)
+		_, ipnet, err := net.ParseCIDR(cast.ToString(conf["subnet"]))
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, ConfigErrorFromString("dhcpv%d: subnet #%d: invalid or missing subnet: %v", ver, idx, conf["subnet"])
+		}
+		pluginList := cast.ToSlice(conf["plugins"])
+		if pluginList == nil {
+			return nil, ConfigErrorFromString("dhcpv%d: subnet %s: invalid plugins section, not a list or no plugin specified", ver, ipnet)
+		}
+		plugins, err := parsePlugins(pluginList)
+		if err != nil {
+			return nil, err
+		}
+		for _, plugin := range plugins {
+			p.logger.Printf("DHCPv%d: found plugin `%s` for subnet %s with %d args: %v", ver, plugin.Name, ipnet, len(plugin.Args), plugin.Args)
+		}
+		subnets = append(subnets, SubnetConfig{Net: *ipnet, Plugins: plugins})
+	}
+	return subnets, nil
+}
+
+func (p *Parser) parseLinks(ver protocolVersion) ([]LinkConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	list := p.v.Get(fmt.Sprintf("server%d.links", ver))
+	if list == nil {
+		return nil, nil
+	}
+	if ver != protocolV6 {
+		return nil, ConfigErrorFromString("dhcpv%d: links are only supported for DHCPv6", ver)
+	}
+	items, err := cast.ToSliceE(list)
+	if err != nil {
+		return nil, ConfigErrorFromString("dhcpv%d: invalid links section, not a list", ver)
+	}
+	links := make([]LinkConfig, 0, len(items))
+	for idx, item := range items {
+		conf := cast.ToStringMap(item)
+		var link LinkConfig
+		if prefix, ok := conf["link"]; ok {
+			_, ipnet, err := net.ParseCIDR(cast.ToString(prefix))
+			if err != nil || ipnet.IP.To4() != nil {
+				return nil, ConfigErrorFromString("dhcpv%d: link #%d: invalid link prefix: %v", ver, idx, prefix)
+			}
+			link.Net = *ipnet
+		}
+		link.InterfaceID = cast.ToString(conf["interface_id"])
+		if link.Net.IP == nil && link.InterfaceID == "" {
+			return nil, ConfigErrorFromString("dhcpv%d: link #%d: need a link prefix or an interface_id", ver, idx)
+		}
+		pluginList := cast.ToSlice(conf["plugins"])
+		if pluginList == nil {
+			return nil, ConfigErrorFromString("dhcpv%d: link #%d: invalid plugins section, not a list or no plugin specified", ver, idx)
+		}
+		link.Plugins, err = parsePlugins(pluginList)
+		if err != nil {
+			return nil, err
+		}
+		for _, plugin := range link.Plugins {
+			p.logger.Printf("DHCPv%d: found plugin `%s` for link #%d with %d args: %v", ver, plugin.Name, idx, len(plugin.Args), plugin.Args)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (p *Parser) parseClasses(ver protocolVersion) ([]ClassConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	list := p.v.Get(fmt.Sprintf("server%d.classes", ver))
+	if list == nil {
+		return nil, nil
+	}
+	items, err := cast.ToSliceE(list)
+	if err != nil {
+		return nil, ConfigErrorFromString("dhcpv%d: invalid classes section, not a list", ver)
+	}
+	classes := make([]ClassConfig, 0, len(items))
+	for idx, item := range items {
+		conf := cast.ToStringMap(item)
+		class := ClassConfig{Name: cast.ToString(conf["class"])}
+		if class.Name == "" {
+			return nil, ConfigErrorFromString("dhcpv%d: class #%d: missing class name", ver, idx)
+		}
+		class.Match.VendorClass = cast.ToString(conf["vendor_class"])
+		class.Match.UserClass = cast.ToString(conf["user_class"])
+		if oui, ok := conf["oui"]; ok {
+			if class.Match.OUI, err = parseOUI(cast.ToString(oui)); err != nil {
+				return nil, ConfigErrorFromString("dhcpv%d: class %s: %v", ver, class.Name, err)
+			}
+		}
+		if htype, ok := conf["hardware_type"]; ok {
+			n, err := cast.ToIntE(htype)
+			if err != nil || n <= 0 || n > 0xffff {
+				return nil, ConfigErrorFromString("dhcpv%d: class %s: invalid hardware type: %v", ver, class.Name, htype)
+			}
+			class.Match.HardwareType = uint16(n)
+		}
+		class.Match.Interface = cast.ToString(conf["interface"])
+		class.Match.CircuitID = cast.ToString(conf["circuit_id"])
+		if class.Match.VendorClass == "" && class.Match.UserClass == "" && class.Match.OUI == nil &&
+			class.Match.HardwareType == 0 && class.Match.Interface == "" && class.Match.CircuitID == "" {
+			return nil, ConfigErrorFromString("dhcpv%d: class %s: need at least one criterion to match requests on", ver, class.Name)
+		}
+		pluginList := cast.ToSlice(conf["plugins"])
+		if pluginList == nil {
+			return nil, ConfigErrorFromString("dhcpv%d: class %s: invalid plugins section, not a list or no plugin specified", ver, class.Name)
+		}
+		class.Plugins, err = parsePlugins(pluginList)
+		if err != nil {
+			return nil, err
+		}
+		for _, plugin := range class.Plugins {
+			p.logger.Printf("DHCPv%d: found plugin `%s` for class %s with %d args: %v", ver, plugin.Name, class.Name, len(plugin.Args), plugin.Args)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+func (p *Parser) parseWorkers(ver protocolVersion) (WorkerConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return WorkerConfig{}, err
+	}
+	var (
+		wc  WorkerConfig
+		err error
+	)
+	if wc.Workers, err = cast.ToIntE(p.v.Get(fmt.Sprintf("server%d.workers", ver))); err != nil || wc.Workers < 0 {
+		return wc, ConfigErrorFromString("dhcpv%d: invalid number of workers: %v", ver, p.v.Get(fmt.Sprintf("server%d.workers", ver)))
+	}
+	if wc.Queue, err = cast.ToIntE(p.v.Get(fmt.Sprintf("server%d.queue", ver))); err != nil || wc.Queue < 0 {
+		return wc, ConfigErrorFromString("dhcpv%d: invalid queue size: %v", ver, p.v.Get(fmt.Sprintf("server%d.queue", ver)))
+	}
+	if wc.Drop, err = parseDropPolicy(cast.ToString(p.v.Get(fmt.Sprintf("server%d.drop", ver)))); err != nil {
+		return wc, ConfigErrorFromString("dhcpv%d: %v", ver, err)
+	}
+	return wc, nil
+}
+
 func (p *Parser) parseConfig(ver protocolVersion) error {
 	if err := protoVersionCheck(ver); err != nil {
 		return err
@@ -134,14 +341,59 @@ func (p *Parser) parseConfig(ver protocolVersion) error {
 		p.logger.Printf("DHCPv%d: found plugin `%s` with %d args: %v", ver, plugin.Name, len(plugin.Args), plugin.Args)
 	}
 
-	listeners, err := p.parseListen(ver)
+	addrs, listeners, err := p.parseListen(ver)
+	if err != nil {
+		return err
+	}
+
+	workers, err := p.parseWorkers(ver)
 	if err != nil {
 		return err
 	}
 
+	subnets, err := p.parseSubnets(ver)
+	if err != nil {
+		return err
+	}
+
+	links, err := p.parseLinks(ver)
+	if err != nil {
+		return err
+	}
+
+	classes, err := p.parseClasses(ver)
+	if err != nil {
+		return err
+	}
+
+	batch, err := cast.ToIntE(p.v.Get(fmt.Sprintf("server%d.batch", ver)))
+	if err != nil {
+		return ConfigErrorFromString("dhcpv%d: invalid batch size: %v", ver, p.v.Get(fmt.Sprintf("server%d.batch", ver)))
+	}
+
+	var timeout time.Duration
+	if t := p.v.Get(fmt.Sprintf("server%d.timeout", ver)); t != nil {
+		// A number without a unit would be read as nanoseconds
+		s, ok := t.(string)
+		if !ok {
+			return ConfigErrorFromString("dhcpv%d: invalid timeout: %v, a unit like 5s is required", ver, t)
+		}
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout < 0 {
+			return ConfigErrorFromString("dhcpv%d: invalid timeout: %v", ver, t)
+		}
+	}
+
 	sc := ServerConfig{
-		Addresses: listeners,
+		Addresses: addrs,
+		Listeners: listeners,
 		Plugins:   plugins,
+		Workers:   workers,
+		Subnets:   subnets,
+		Links:     links,
+		Classes:   classes,
+		Batch:     batch,
+		Timeout:   timeout,
 	}
 	if ver == protocolV6 {
 		p.config.Server6 = &sc
@@ -0,0 +1,142 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package handler
+
+import (
+	"context"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/sirupsen/logrus"
+)
+
+// Context carries what the server knows about a request through the chain of
+// handlers. The embedded context.Context is done when the request isn't worth
+// answering anymore, as the client will have retransmitted it; the server
+// drops the response if its deadline is exceeded once the chain is done.
+// A Context is only used by the goroutine handling the request.
+type Context struct {
+	context.Context
+	// IfIndex is the index of the interface the request was received on, 0
+	// if unknown
+	IfIndex int
+	// Peer is the address the request was received from, the client's or
+	// the closest relay's
+	Peer *net.UDPAddr
+	// Relays are the Relay-Forward messages a DHCPv6 request was relayed in,
+	// from the relay closest to the server to the one closest to the client.
+	// It is empty for direct requests. DHCPv4 relays are described by the
+	// request itself, with giaddr and option 82 (see package relayinfo)
+	Relays []*dhcpv6.RelayMessage
+	// Log is a logger for messages about the request
+	Log logrus.FieldLogger
+
+	values map[string]interface{}
+}
+
+// NewContext returns a Context for a request, with no information about it
+func NewContext(parent context.Context, log logrus.FieldLogger) *Context {
+	return &Context{Context: parent, Log: log}
+}
+
+// Set stores a value for later handlers in the chain to retrieve with Get.
+// Keys should be prefixed with the name of the plugin setting them, to avoid
+// collisions, e.g. "range.lease"
+func (c *Context) Set(key string, value interface{}) {
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Get retrieves a value stored by an earlier handler with Set
+func (c *Context) Get(key string) (interface{}, bool) {
+	v, ok := c.values[key]
+	return v, ok
+}
+
+// Interface returns the interface the request was received on
+func (c *Context) Interface() (*net.Interface, error) {
+	return net.InterfaceByIndex(c.IfIndex)
+}
+
+// Action is what the server does after a handler ran
+type Action int
+
+const (
+	// ActionContinue passes the response to the next handler, or sends it if
+	// there is none
+	ActionContinue Action = iota
+	// ActionRespond sends the response right away, skipping the next handlers
+	ActionRespond
+	// ActionDrop doesn't answer the request
+	ActionDrop
+)
+
+// Result is returned by a handler along with the response, to tell the server
+// what to do next
+type Result struct {
+	Action Action
+	// Reason explains why the request is dropped, for logs and statistics
+	Reason string
+}
+
+var (
+	// Continue passes the response to the next handler
+	Continue = Result{Action: ActionContinue}
+	// Respond sends the response right away, skipping the next handlers
+	Respond = Result{Action: ActionRespond}
+)
+
+// Drop doesn't answer the request, for the given reason. The reason should be
+// short and not depend on the request (e.g. "no address available"), as drops
+// are counted by reason; details belong in the plugin's logs
+func Drop(reason string) Result {
+	return Result{Action: ActionDrop, Reason: reason}
+}
+
+// ReasonNoResponse is the reason of the drops of handlers returning a nil
+// response, including the handlers not using Result
+const ReasonNoResponse = "no response"
+
+// result maps the return values of a Handler6 or Handler4 to a Result: a nil
+// response is a drop, and stopping the chain sends the response right away
+func result(noResponse, stop bool) Result {
+	switch {
+	case noResponse:
+		return Drop(ReasonNoResponse)
+	case stop:
+		return Respond
+	default:
+		return Continue
+	}
+}
+
+// ContextHandler6 is like Handler6, but also receives the context of the
+// request, and returns what to do next explicitly. The response is ignored
+// when dropping the request
+type ContextHandler6 func(ctx *Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, Result)
+
+// ContextHandler4 behaves like ContextHandler6, but for DHCPv4 packets.
+type ContextHandler4 func(ctx *Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, Result)
+
+// WithContext6 adapts a Handler6 to a ContextHandler6 ignoring the context. A
+// nil response drops the request, with "no response" as the reason
+func WithContext6(h Handler6) ContextHandler6 {
+	return func(_ *Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, Result) {
+		resp, stop := h(req, resp)
+		return resp, result(resp == nil, stop)
+	}
+}
+
+// WithContext4 adapts a Handler4 to a ContextHandler4 ignoring the context. A
+// nil response drops the request, with "no response" as the reason
+func WithContext4(h Handler4) ContextHandler4 {
+	return func(_ *Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, Result) {
+		resp, stop := h(req, resp)
+		return resp, result(resp == nil, stop)
+	}
+}
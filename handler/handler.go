@@ -17,6 +17,8 @@ import (
 // the result will be returned by the handler.
 // If the returned boolean is true, the returned packet may be nil or
 // invalid, in which case no response will be sent.
+// A nil response always drops the request. ContextHandler6 makes the
+// distinction between dropping and answering right away explicit.
 type Handler6 func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool)
 
 // Handler4 behaves like Handler6, but for DHCPv4 packets.
@@ -0,0 +1,123 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+// This allocator hands out single IPv6 addresses from an arbitrary range,
+// with the same logic as the IPv4 allocator. Offsets are computed with the
+// 128-bit helpers of the allocators package
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/insei/coredhcp/plugins/allocators"
+	"github.com/willf/bitset"
+)
+
+// MaxIPv6RangeSize is the largest number of addresses an IPv6Allocator can
+// manage, a /104. The bitmap is allocated up front, this bounds it to 2MiB
+const MaxIPv6RangeSize = 1 << 24
+
+var errNotInRange6 = errors.New("IPv6 address outside of allowed range")
+
+// IPv6Allocator allocates IPv6 addresses, tracking utilization with a bitmap
+type IPv6Allocator struct {
+	start net.IP
+	end   net.IP
+
+	// This bitset implementation isn't goroutine-safe, we protect it with a mutex for now
+	// until we can swap for another concurrent implementation
+	bitmap *bitset.BitSet
+	l      sync.Mutex
+}
+
+func (a *IPv6Allocator) toIP(offset uint) net.IP {
+	ip, err := allocators.AddPrefixes(a.start, uint64(offset), 128)
+	if err != nil {
+		panic("BUG: offset out of bounds")
+	}
+	return ip
+}
+
+func (a *IPv6Allocator) toOffset(ip net.IP) (uint, error) {
+	if ip.To16() == nil || ip.To4() != nil {
+		return 0, errInvalidIP
+	}
+	ip = ip.To16()
+	if bytes.Compare(ip, a.start) < 0 || bytes.Compare(ip, a.end) > 0 {
+		return 0, errNotInRange6
+	}
+	offset, err := allocators.Offset(ip, a.start, 128)
+	return uint(offset), err
+}
+
+// Allocate reserves an IP for a client
+func (a *IPv6Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
+	n.Mask = net.CIDRMask(128, 128)
+
+	// This is just a hint, ignore any error with it
+	hintOffset, _ := a.toOffset(hint.IP)
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	var next uint
+	// First try the exact match
+	if !a.bitmap.Test(hintOffset) {
+		next = hintOffset
+	} else {
+		// Then any available address
+		avail, ok := a.bitmap.NextClear(0)
+		if !ok {
+			return n, allocators.ErrNoAddrAvail
+		}
+		next = avail
+	}
+
+	a.bitmap.Set(next)
+	n.IP = a.toIP(next)
+	return
+}
+
+// Free releases the given IP
+func (a *IPv6Allocator) Free(n net.IPNet) error {
+	offset, err := a.toOffset(n.IP)
+	if err != nil {
+		return errNotInRange6
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if !a.bitmap.Test(offset) {
+		return &allocators.ErrDoubleFree{Loc: n}
+	}
+	a.bitmap.Clear(offset)
+	return nil
+}
+
+// NewIPv6Allocator creates a new allocator suitable for giving out IPv6
+// addresses within [start, end]
+func NewIPv6Allocator(start, end net.IP) (*IPv6Allocator, error) {
+	if start.To16() == nil || start.To4() != nil || end.To16() == nil || end.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 addresses given to create the allocator: [%s,%s]", start, end)
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, errors.New("no IPs in the given range to allocate")
+	}
+	size, err := allocators.Offset(end.To16(), start.To16(), 128)
+	if err != nil || size >= MaxIPv6RangeSize {
+		return nil, fmt.Errorf("range [%s,%s] is too large, it can hold at most %d addresses", start, end, uint64(MaxIPv6RangeSize))
+	}
+
+	return &IPv6Allocator{
+		start:  start.To16(),
+		end:    end.To16(),
+		bitmap: bitset.New(uint(size + 1)),
+	}, nil
+}
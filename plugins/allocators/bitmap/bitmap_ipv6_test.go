@@ -0,0 +1,86 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package bitmap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insei/coredhcp/plugins/allocators"
+)
+
+func getv6Allocator() *IPv6Allocator {
+	alloc, err := NewIPv6Allocator(net.ParseIP("2001:db8::ff"), net.ParseIP("2001:db8::1:1"))
+	if err != nil {
+		panic(err)
+	}
+
+	return alloc
+}
+
+func Test6Alloc(t *testing.T) {
+	alloc := getv6Allocator()
+
+	net1, err := alloc.Allocate(net.IPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net1.IP.Equal(net.ParseIP("2001:db8::ff")) {
+		t.Fatalf("Expected the start of the range, got %s", net1.IP)
+	}
+
+	net2, err := alloc.Allocate(net.IPNet{IP: net.ParseIP("2001:db8::1:0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net2.IP.Equal(net.ParseIP("2001:db8::1:0")) {
+		t.Fatalf("Hint was not honored, got %s", net2.IP)
+	}
+
+	err = alloc.Free(net1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alloc.Free(net1)
+	if err == nil {
+		t.Fatal("Expected DoubleFree error")
+	}
+}
+
+func Test6Exhaustion(t *testing.T) {
+	alloc := getv6Allocator()
+
+	// 2001:db8::ff to 2001:db8::1:1 holds 0xff03 addresses
+	seen := make(map[string]bool)
+	for i := 0; i < 0xff03; i++ {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		if seen[n.IP.String()] {
+			t.Fatalf("Address %s allocated twice", n.IP)
+		}
+		seen[n.IP.String()] = true
+	}
+	if _, err := alloc.Allocate(net.IPNet{}); err != allocators.ErrNoAddrAvail {
+		t.Fatalf("Expected ErrNoAddrAvail, got %v", err)
+	}
+}
+
+func Test6InvalidRange(t *testing.T) {
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1")); err == nil {
+		t.Fatal("Reversed range was accepted")
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::100:0")); err == nil {
+		t.Fatal("Range too large for a bitmap was accepted")
+	}
+	if _, err := NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ff:ffff")); err != nil {
+		t.Fatalf("Largest range was rejected: %v", err)
+	}
+	if _, err := NewIPv6Allocator(net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 255)); err == nil {
+		t.Fatal("IPv4 range was accepted")
+	}
+}
@@ -47,6 +47,23 @@ import (
 // A `nil` setup function means that that protocol won't be handled by this
 // plugin.
 //
+// Plugins holding resources that must be released when the server stops, like
+// open files or goroutines, use Init6 and Init4 instead. They conform to the
+// `plugins.InitFunc6` and `plugins.InitFunc4` interfaces, and additionally
+// return an `io.Closer` called on shutdown, in the reverse order of loading.
+// When the configuration is reloaded, plugins whose arguments didn't change
+// keep their instance; if the closer also implements `plugins.Reloader`, its
+// Reload method is called so the plugin can refresh its state.
+//
+// Handlers which need to know more about a request than its content, like
+// the interface or relays it came through, or which pass data to the plugins
+// after them, are set up with InitContext6 and InitContext4 instead. Their
+// handlers conform to `handler.ContextHandler6` and `handler.ContextHandler4`,
+// and receive a `*handler.Context` before the request and response packets.
+// They return a `handler.Result` instead of a boolean: `handler.Continue`,
+// `handler.Respond` to reply right away, or `handler.Drop` with a reason that
+// the server logs and counts for the plugin.
+//
 // Note that importing the plugin is not enough to use it: you have to
 // explicitly specify the intention to use it in the `config.yml` file, in the
 // plugins section. For example:
@@ -25,12 +25,14 @@
 //
 // Optionally, when the 'autorefresh' argument is given, the plugin will try to refresh
 // the lease mapping during runtime whenever the lease file is updated.
+// Otherwise, the lease mapping is refreshed when the server configuration is reloaded.
 package file
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"strings"
@@ -53,9 +55,9 @@ const (
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   pluginName,
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:  pluginName,
+	Init6: setup6,
+	Init4: setup4,
 }
 
 type pluginState struct {
@@ -63,6 +65,10 @@ type pluginState struct {
 	// staticRecords holds a MAC -> IP address mapping
 	staticRecords map[string]net.IP
 	log           logrus.FieldLogger
+	filename      string
+	v6            bool
+	// watcher watches the lease file when autorefresh is set, nil otherwise
+	watcher *fsnotify.Watcher
 }
 
 // LoadDHCPv4Records loads the DHCPv4Records global map with records stored on
@@ -192,24 +198,47 @@ func (p *pluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 	return resp, true
 }
 
-func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, error) {
+// Reload refreshes the lease mapping from the lease file
+func (p *pluginState) Reload() error {
+	if err := p.loadFromFile(p.v6, p.filename); err != nil {
+		return err
+	}
+	p.log.Infof("reloaded %d leases from %s", len(p.staticRecords), p.filename)
+	return nil
+}
+
+// Close stops watching the lease file, if it was
+func (p *pluginState) Close() error {
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.Close()
+}
+
+func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, io.Closer, error) {
 	pState := &pluginState{
 		recLock:       sync.RWMutex{},
 		staticRecords: map[string]net.IP{},
 		log:           logger.CreatePluginLogger(serverLogger, pluginName, true),
 	}
 	h6, _, err := pState.setupFile(true, args...)
-	return h6, err
+	if err != nil {
+		return nil, nil, err
+	}
+	return h6, pState, nil
 }
 
-func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, error) {
+func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
 	pState := &pluginState{
 		recLock:       sync.RWMutex{},
 		staticRecords: map[string]net.IP{},
 		log:           logger.CreatePluginLogger(serverLogger, pluginName, false),
 	}
 	_, h4, err := pState.setupFile(false, args...)
-	return h4, err
+	if err != nil {
+		return nil, nil, err
+	}
+	return h4, pState, nil
 }
 
 func (p *pluginState) setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
@@ -222,6 +251,9 @@ func (p *pluginState) setupFile(v6 bool, args ...string) (handler.Handler6, hand
 		return nil, nil, errors.New("got empty file name")
 	}
 
+	p.filename = filename
+	p.v6 = v6
+
 	// load initial database from lease file
 	if err = p.loadFromFile(v6, filename); err != nil {
 		return nil, nil, err
@@ -238,8 +270,10 @@ func (p *pluginState) setupFile(v6 bool, args ...string) (handler.Handler6, hand
 
 		// have file watcher watch over lease file
 		if err = watcher.Add(filename); err != nil {
+			watcher.Close()
 			return nil, nil, fmt.Errorf("failed to watch %s: %w", filename, err)
 		}
+		p.watcher = watcher
 
 		// very simple watcher on the lease file to trigger a refresh on any event
 		// on the file
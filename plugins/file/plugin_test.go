@@ -224,7 +224,7 @@ func TestHandler4(t *testing.T) {
 	//In 2 iteration of test we need to get ip address from leases file
 	_, err = f.WriteString("00:11:22:33:44:56 192.0.2.100\n")
 
-	handler4, err := setup4(testsLogger, f.Name())
+	handler4, _, err := setup4(testsLogger, f.Name())
 	if err != nil {
 		t.Errorf("failed to setup dns plugin: %s", err)
 	}
@@ -276,7 +276,7 @@ func TestHandler6(t *testing.T) {
 	//In 2 iteration of test we need to get ip address from leases file
 	_, err = f.WriteString("11:22:33:44:55:77 2001:db8::10:1\n")
 
-	handler6, err := setup6(testsLogger, f.Name())
+	handler6, _, err := setup6(testsLogger, f.Name())
 	if err != nil {
 		t.Errorf("failed to setup dns plugin: %s", err)
 	}
@@ -321,24 +321,24 @@ func TestHandler6(t *testing.T) {
 
 func TestSetup(t *testing.T) {
 	// too few arguments
-	_, err := setup4(testsLogger)
+	_, _, err := setup4(testsLogger)
 	assert.Error(t, err)
 
-	_, err = setup6(testsLogger)
+	_, _, err = setup6(testsLogger)
 	assert.Error(t, err)
 
 	// empty file name
-	_, err = setup4(testsLogger, "")
+	_, _, err = setup4(testsLogger, "")
 	assert.Error(t, err)
 
-	_, err = setup6(testsLogger, "")
+	_, _, err = setup6(testsLogger, "")
 	assert.Error(t, err)
 
 	// trigger error in LoadDHCPv*Records
-	_, err = setup4(testsLogger, "/foo/bar")
+	_, _, err = setup4(testsLogger, "/foo/bar")
 	assert.Error(t, err)
 
-	_, err = setup6(testsLogger, "/foo/bar")
+	_, _, err = setup6(testsLogger, "/foo/bar")
 	assert.Error(t, err)
 
 	// Correct setup v4 empty leases file with auto refresh
@@ -346,7 +346,7 @@ func TestSetup(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(emptyLeases4file.Name())
 
-	_, err = setup4(testsLogger, emptyLeases4file.Name(), autoRefreshArg)
+	_, _, err = setup4(testsLogger, emptyLeases4file.Name(), autoRefreshArg)
 	assert.NoError(t, err)
 
 	// Correct setup v4 with not empty leases file with auto refresh
@@ -355,7 +355,7 @@ func TestSetup(t *testing.T) {
 	defer os.Remove(leases4file.Name())
 
 	_, err = leases4file.WriteString("00:11:22:33:44:56 192.0.2.100\n")
-	_, err = setup4(testsLogger, leases4file.Name(), autoRefreshArg)
+	_, _, err = setup4(testsLogger, leases4file.Name(), autoRefreshArg)
 	assert.NoError(t, err)
 
 	// Correct setup v6 empty leases file with auto refresh
@@ -363,7 +363,7 @@ func TestSetup(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(emptyLeases6file.Name())
 
-	_, err = setup6(testsLogger, emptyLeases6file.Name(), autoRefreshArg)
+	_, _, err = setup6(testsLogger, emptyLeases6file.Name(), autoRefreshArg)
 	assert.NoError(t, err)
 
 	// Correct setup v6 with not empty leases file with auto refresh
@@ -372,7 +372,7 @@ func TestSetup(t *testing.T) {
 	defer os.Remove(leases6file.Name())
 
 	_, err = leases6file.WriteString("11:22:33:44:55:77 2001:db8::10:1\n")
-	_, err = setup6(testsLogger, leases6file.Name(), autoRefreshArg)
+	_, _, err = setup6(testsLogger, leases6file.Name(), autoRefreshArg)
 	assert.NoError(t, err)
 }
 
@@ -381,7 +381,7 @@ func TestAutoRefresh4(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	handler4, err := setup4(testsLogger, f.Name(), autoRefreshArg)
+	handler4, _, err := setup4(testsLogger, f.Name(), autoRefreshArg)
 	if err != nil {
 		t.Errorf("failed to setup dns plugin: %s", err)
 	}
@@ -415,7 +415,7 @@ func TestAutoRefresh6(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	handler6, err := setup6(testsLogger, f.Name(), autoRefreshArg)
+	handler6, _, err := setup6(testsLogger, f.Name(), autoRefreshArg)
 	if err != nil {
 		t.Errorf("failed to setup dns plugin: %s", err)
 	}
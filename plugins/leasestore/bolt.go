@@ -0,0 +1,127 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+// The bolt backend stores leases in an embedded bbolt key/value database,
+// keyed by address. It is better suited than the file backend to large
+// numbers of leases, since it doesn't need to be compacted
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var leasesBucket = []byte("leases")
+
+// BoltStore is a LeaseStore backed by a bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// boltValue is the serialized form of a lease. The address is the key
+type boltValue struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewBoltStore opens the bbolt database at path, creating it if needed
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("lease database name cannot be empty")
+	}
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lease database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(leasesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot initialize lease database %s: %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func decodeLease(k, v []byte) (*Lease, error) {
+	addr, err := parseAddr(string(k))
+	if err != nil {
+		return nil, fmt.Errorf("malformed lease key %q: %w", k, err)
+	}
+	var val boltValue
+	if err := json.Unmarshal(v, &val); err != nil {
+		return nil, fmt.Errorf("malformed lease for %s: %w", addr.String(), err)
+	}
+	return &Lease{Owner: val.Owner, Addr: addr, Expires: val.Expires}, nil
+}
+
+// Load implements LeaseStore.Load
+func (s *BoltStore) Load(addr net.IPNet) (lease *Lease, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(leasesBucket).Get([]byte(key(addr)))
+		if v == nil {
+			return ErrNotFound
+		}
+		lease, err = decodeLease([]byte(key(addr)), v)
+		return err
+	})
+	return lease, err
+}
+
+// Upsert implements LeaseStore.Upsert
+func (s *BoltStore) Upsert(lease *Lease) error {
+	if err := checkLease(lease); err != nil {
+		return err
+	}
+	v, err := json.Marshal(boltValue{Owner: lease.Owner, Expires: lease.Expires})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(leasesBucket).Put([]byte(key(lease.Addr)), v)
+	})
+}
+
+// Delete implements LeaseStore.Delete
+func (s *BoltStore) Delete(addr net.IPNet) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(leasesBucket).Delete([]byte(key(addr)))
+	})
+}
+
+// Iterate implements LeaseStore.Iterate
+func (s *BoltStore) Iterate(fn func(*Lease) error) error {
+	// Decode everything first, so that fn can use the store
+	var leases []*Lease
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(leasesBucket).ForEach(func(k, v []byte) error {
+			lease, err := decodeLease(k, v)
+			if err != nil {
+				return err
+			}
+			leases = append(leases, lease)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		if err := fn(lease); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements LeaseStore.Close
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
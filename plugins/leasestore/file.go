@@ -0,0 +1,371 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+// The file backend stores leases in an append-only text file, one operation
+// per line: "<owner> <address> <expiry>", where the address is either a bare
+// IP or a prefix in CIDR notation, and the expiry is in RFC3339 format, or
+// `-` to record the deletion of the lease. The last line for an address wins.
+// The file is periodically rewritten to only hold the current leases.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insei/coredhcp/logger"
+)
+
+var log = logger.GetLogger("plugins/leasestore")
+
+// compactMinLines is the number of lines under which the lease file is never
+// compacted because of its size
+const compactMinLines = 1024
+
+// deletedMarker replaces the expiry on lines recording a lease deletion
+const deletedMarker = "-"
+
+// FileStore is a LeaseStore backed by an append-only text file
+type FileStore struct {
+	sync.Mutex
+	filename string
+	file     *os.File
+	leases   map[string]*Lease
+	// lines is the number of lines written to the file since it was last
+	// compacted
+	lines int
+}
+
+// parseAddr parses a bare IP address or a prefix
+func parseAddr(s string) (net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return net.IPNet{}, err
+		}
+		if !ip.Equal(prefix.IP) {
+			return net.IPNet{}, fmt.Errorf("%s is not the start of a prefix", s)
+		}
+		return *prefix, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid IP address: %s", s)
+	}
+	return HostNet(ip), nil
+}
+
+// formatAddr is the converse of parseAddr
+func formatAddr(addr net.IPNet) string {
+	if ones, bits := addr.Mask.Size(); ones == bits {
+		return addr.IP.String()
+	}
+	return key(addr)
+}
+
+// parseLine parses a single line of the lease file. For deletions, the
+// returned lease has a zero expiry and deleted is true
+func parseLine(line string) (lease *Lease, deleted bool, err error) {
+	tokens := strings.Fields(line)
+	if len(tokens) != 3 {
+		return nil, false, fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
+	}
+	addr, err := parseAddr(tokens[1])
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed address: %w", err)
+	}
+	lease = &Lease{Owner: tokens[0], Addr: addr}
+	if tokens[2] == deletedMarker {
+		return lease, true, nil
+	}
+	lease.Expires, err = time.Parse(time.RFC3339, tokens[2])
+	if err != nil {
+		return nil, false, fmt.Errorf("expected time of expiry in RFC3339 format, got: %v", tokens[2])
+	}
+	return lease, false, nil
+}
+
+// formatLine formats a lease as a line of the lease file
+func formatLine(lease *Lease, deleted bool) string {
+	expires := deletedMarker
+	if !deleted {
+		expires = lease.Expires.Format(time.RFC3339)
+	}
+	return lease.Owner + " " + formatAddr(lease.Addr) + " " + expires + "\n"
+}
+
+// loadLeases replays the lines of a lease file and returns the resulting leases
+func loadLeases(r io.Reader) (map[string]*Lease, error) {
+	sc := bufio.NewScanner(r)
+	leases := make(map[string]*Lease)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) == 0 {
+			continue
+		}
+		lease, deleted, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			delete(leases, key(lease.Addr))
+		} else {
+			leases[key(lease.Addr)] = lease
+		}
+	}
+	return leases, sc.Err()
+}
+
+// repairFile detects a last line that was only partially written, for
+// example because the server crashed in the middle of a write. A partial
+// line that is still valid is completed, otherwise the file is truncated
+// back to the end of the last complete line.
+func repairFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	tail := string(data[end:])
+	if _, _, err := parseLine(tail); err == nil {
+		log.Warningf("Lease file %s is missing a final newline, adding it", filename)
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.WriteString("\n"); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	log.Warningf("Discarding truncated last line of lease file %s: %q", filename, tail)
+	return os.Truncate(filename, int64(end))
+}
+
+// writeFile atomically replaces the file at filename with one containing
+// exactly the given leases: they are written to a temporary file in the same
+// directory, which is synced and then renamed over the original file
+func writeFile(filename string, leases map[string]*Lease) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary lease file: %w", err)
+	}
+	// Only has an effect if anything fails before the rename
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if fi, err := os.Stat(filename); err == nil {
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, k := range sortedKeys(leases) {
+		if _, err := w.WriteString(formatLine(leases[k], false)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func sortedKeys(leases map[string]*Lease) []string {
+	keys := make([]string, 0, len(leases))
+	for k := range leases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewFileStore opens the lease file at filename, creating it if needed.
+// The file is repaired if its last write was interrupted, and compacted.
+func NewFileStore(filename string) (*FileStore, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("lease file name cannot be empty")
+	}
+	if err := repairFile(filename); err != nil {
+		return nil, fmt.Errorf("cannot repair lease file %s: %w", filename, err)
+	}
+	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lease file %s: %w", filename, err)
+	}
+	leases, err := loadLeases(f)
+	if err := f.Close(); err != nil {
+		log.Warningf("Failed to close file %s: %v", filename, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load lease file %s: %w", filename, err)
+	}
+
+	s := FileStore{filename: filename, leases: leases}
+	// Start from a file holding only the current leases, this also gets rid
+	// of the history replayed above
+	if err := s.compact(); err != nil {
+		return nil, fmt.Errorf("could not compact lease file %s: %w", filename, err)
+	}
+	return &s, nil
+}
+
+// Load implements LeaseStore.Load
+func (s *FileStore) Load(addr net.IPNet) (*Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+	lease, ok := s.leases[key(addr)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	l := *lease
+	return &l, nil
+}
+
+// Upsert implements LeaseStore.Upsert
+func (s *FileStore) Upsert(lease *Lease) error {
+	if err := checkLease(lease); err != nil {
+		return err
+	}
+	l := *lease
+	s.Lock()
+	defer s.Unlock()
+	if err := s.append(&l, false); err != nil {
+		return err
+	}
+	s.leases[key(l.Addr)] = &l
+	return s.maybeCompact()
+}
+
+// Delete implements LeaseStore.Delete
+func (s *FileStore) Delete(addr net.IPNet) error {
+	s.Lock()
+	defer s.Unlock()
+	lease, ok := s.leases[key(addr)]
+	if !ok {
+		return nil
+	}
+	if err := s.append(lease, true); err != nil {
+		return err
+	}
+	delete(s.leases, key(addr))
+	return s.maybeCompact()
+}
+
+// Iterate implements LeaseStore.Iterate
+func (s *FileStore) Iterate(fn func(*Lease) error) error {
+	s.Lock()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, *lease)
+	}
+	s.Unlock()
+	for i := range leases {
+		if err := fn(&leases[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements LeaseStore.Close
+func (s *FileStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Compact rewrites the lease file so it only holds the current leases
+func (s *FileStore) Compact() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("lease file %s is closed", s.filename)
+	}
+	return s.compact()
+}
+
+// append writes out a lease operation. It must be called with the lock held
+func (s *FileStore) append(lease *Lease, deleted bool) error {
+	if s.file == nil {
+		return fmt.Errorf("lease file %s is closed", s.filename)
+	}
+	if _, err := s.file.WriteString(formatLine(lease, deleted)); err != nil {
+		return err
+	}
+	s.lines++
+	return s.file.Sync()
+}
+
+// maybeCompact compacts the lease file once it holds mostly stale lines. It
+// must be called with the lock held
+func (s *FileStore) maybeCompact() error {
+	if s.lines > compactMinLines && s.lines > 2*len(s.leases) {
+		if err := s.compact(); err != nil {
+			return fmt.Errorf("could not compact lease file %s: %w", s.filename, err)
+		}
+	}
+	return nil
+}
+
+// compact does the work of Compact. It must be called with the lock held
+func (s *FileStore) compact() error {
+	if err := writeFile(s.filename, s.leases); err != nil {
+		return err
+	}
+	// The file we had open was unlinked by the rename, switch to the new one
+	f, err := os.OpenFile(s.filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open lease file %s: %w", s.filename, err)
+	}
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			log.Warningf("Failed to close old lease file: %v", err)
+		}
+	}
+	s.file = f
+	s.lines = len(s.leases)
+	return nil
+}
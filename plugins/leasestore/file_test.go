@@ -0,0 +1,133 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var leasefile = `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
+02:00:00:00:00:01 10.0.0.1 2000-01-01T00:00:00Z
+00010001aabbccddeeff 2001:db8::/64 2000-01-01T00:00:00Z
+00010001aabbccddeeff 2001:db8::1 2000-01-01T00:00:00Z
+`
+
+func TestLoadLeases(t *testing.T) {
+	expire := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+	// Replay of updates and deletions, the last line for an address wins
+	history := strings.ReplaceAll(leasefile, "2000-01-01", "1999-01-01") +
+		leasefile +
+		"02:00:00:00:00:02 10.0.0.2 2000-01-01T00:00:00Z\n" +
+		"02:00:00:00:00:02 10.0.0.2 -\n"
+
+	leases, err := loadLeases(strings.NewReader(history))
+	require.NoError(t, err)
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+	assert.Equal(t, map[string]*Lease{
+		"10.0.0.0/32":     {"02:00:00:00:00:00", HostNet(net.IPv4(10, 0, 0, 0)), expire},
+		"10.0.0.1/32":     {"02:00:00:00:00:01", HostNet(net.IPv4(10, 0, 0, 1)), expire},
+		"2001:db8::/64":   {"00010001aabbccddeeff", *prefix, expire},
+		"2001:db8::1/128": {"00010001aabbccddeeff", HostNet(net.ParseIP("2001:db8::1")), expire},
+	}, leases)
+
+	_, err = loadLeases(strings.NewReader("02:00:00:00:00:00 10.0.0.0\n"))
+	assert.Error(t, err, "Line with missing fields was accepted")
+	_, err = loadLeases(strings.NewReader("02:00:00:00:00:00 2001:db8::1/64 -\n"))
+	assert.Error(t, err, "Address with host bits set was accepted as a prefix")
+}
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "leases.txt")
+
+	// A file with a stale line for each lease
+	history := strings.ReplaceAll(leasefile, "2000-01-01", "1999-01-01") + leasefile
+	require.NoError(t, ioutil.WriteFile(filename, []byte(history), 0640))
+
+	// Opening the store compacts the file
+	s, err := NewFileStore(filename)
+	require.NoError(t, err)
+	defer s.Close()
+	written, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, strings.SplitAfter(leasefile, "\n"), strings.SplitAfter(string(written), "\n"),
+		"Compacted file doesn't match leases")
+
+	fi, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm(), "Compaction changed the file permissions")
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers, "Temporary file left behind")
+
+	// Writes after a compaction go to the new file
+	require.NoError(t, s.Delete(HostNet(net.IPv4(10, 0, 0, 0))))
+	require.NoError(t, s.Compact())
+	require.NoError(t, s.Delete(HostNet(net.IPv4(10, 0, 0, 1))))
+	written, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.NotContains(t, string(written), "10.0.0.0 ")
+	assert.Contains(t, string(written), "02:00:00:00:00:01 10.0.0.1 -\n")
+
+	// Size-triggered compaction
+	lease := Lease{Owner: "02:00:00:00:00:00", Addr: HostNet(net.IPv4(10, 0, 0, 0))}
+	for i := 0; i < 2*compactMinLines; i++ {
+		lease.Expires = time.Unix(int64(i), 0)
+		require.NoError(t, s.Upsert(&lease))
+	}
+	assert.LessOrEqual(t, s.lines, compactMinLines+1, "File was not compacted after growing")
+}
+
+func TestRepairFile(t *testing.T) {
+	testcases := []struct {
+		name     string
+		contents string
+		repaired string
+	}{
+		{"intact", leasefile, leasefile},
+		{"empty", "", ""},
+		{"truncated", leasefile + "02:00:00:00:00:06 10.0.0.6 2000-01", leasefile},
+		{"missing newline", strings.TrimSuffix(leasefile, "\n"), leasefile},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpfile, err := ioutil.TempFile("", "coredhcptest")
+			if err != nil {
+				t.Skipf("Could not setup file-based test: %v", err)
+			}
+			defer os.Remove(tmpfile.Name())
+			tmpfile.Close()
+			require.NoError(t, ioutil.WriteFile(tmpfile.Name(), []byte(tc.contents), 0640))
+
+			if err := repairFile(tmpfile.Name()); err != nil {
+				t.Fatalf("Could not repair lease file: %v", err)
+			}
+			repaired, err := ioutil.ReadFile(tmpfile.Name())
+			require.NoError(t, err)
+			assert.Equal(t, tc.repaired, string(repaired))
+
+			s, err := NewFileStore(tmpfile.Name())
+			if assert.NoError(t, err, "Repaired file could not be loaded") {
+				s.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default maintenance intervals, for the plugins whose `sweep` and `compact`
+// arguments aren't given
+const (
+	// DefaultSweepInterval is how often expired leases are looked for
+	DefaultSweepInterval = time.Minute
+	// DefaultCompactInterval is how often the lease storage is compacted
+	DefaultCompactInterval = time.Hour
+)
+
+// Maintainer runs the background maintenance of the leases of a plugin: it
+// periodically reclaims the expired ones and compacts the store, if it
+// supports it
+type Maintainer struct {
+	store           LeaseStore
+	lock            sync.Locker
+	log             logrus.FieldLogger
+	reclaim         func(now time.Time) int
+	sweepInterval   time.Duration
+	compactInterval time.Duration
+	// stop ends the maintenance goroutine, which closes stopped once done.
+	// They are nil while the maintenance is stopped
+	stop    chan struct{}
+	stopped chan struct{}
+	// handedOver is set while the store is handed over, and once the plugin
+	// instance is retired. It is protected by lock
+	handedOver bool
+}
+
+// Maintain starts maintaining the leases of a plugin. reclaim is called every
+// sweepInterval to free the leases expired at the given time, and returns how
+// many it freed. A zero compactInterval disables periodic compaction. lock is
+// held by the plugin while it uses the store, and taken to close it. store can
+// be nil for plugins which don't persist their leases
+func Maintain(log logrus.FieldLogger, store LeaseStore, lock sync.Locker, reclaim func(now time.Time) int, sweepInterval, compactInterval time.Duration) *Maintainer {
+	m := &Maintainer{
+		store:           store,
+		lock:            lock,
+		log:             log,
+		reclaim:         reclaim,
+		sweepInterval:   sweepInterval,
+		compactInterval: compactInterval,
+	}
+	m.start()
+	return m
+}
+
+// start starts the maintenance goroutine
+func (m *Maintainer) start() {
+	m.stop = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go m.run(m.stop, m.stopped)
+}
+
+// halt stops the maintenance goroutine, if it runs
+func (m *Maintainer) halt() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.stopped
+	m.stop, m.stopped = nil, nil
+}
+
+// run runs the maintenance until stop is closed
+func (m *Maintainer) run(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	sweepTicker := time.NewTicker(m.sweepInterval)
+	defer sweepTicker.Stop()
+	var compactC <-chan time.Time
+	compacter, ok := m.store.(Compacter)
+	if ok && m.compactInterval > 0 {
+		compactTicker := time.NewTicker(m.compactInterval)
+		defer compactTicker.Stop()
+		compactC = compactTicker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-sweepTicker.C:
+			if n := m.reclaim(now); n > 0 {
+				m.log.Infof("Reclaimed %d expired leases", n)
+			}
+		case <-compactC:
+			if err := compacter.Compact(); err != nil {
+				m.log.Errorf("Could not compact lease storage: %v", err)
+			}
+		}
+	}
+}
+
+// Handover prepares the plugin instance to be replaced on reload, before its
+// replacement is set up: the maintenance stops, the plugin must not change
+// leases anymore (see HandedOver), and the store is handed over to the next
+// Open of its path. done is called once the reload is over: a retired instance
+// then stays idle until closed, otherwise it resumes. It implements
+// plugins.Handover
+func (m *Maintainer) Handover() (done func(retired bool)) {
+	m.halt()
+	m.lock.Lock()
+	m.handedOver = true
+	m.lock.Unlock()
+	withdraw := handOver(m.store)
+	return func(retired bool) {
+		withdraw()
+		if retired {
+			return
+		}
+		m.lock.Lock()
+		m.handedOver = false
+		m.lock.Unlock()
+		m.start()
+	}
+}
+
+// HandedOver returns true if the store is handed over to another instance of
+// the plugin, which doesn't see the leases changed by this one. It must be
+// called with the lock held
+func (m *Maintainer) HandedOver() bool {
+	return m.handedOver
+}
+
+// Close stops the maintenance and closes the store, if any
+func (m *Maintainer) Close() error {
+	m.halt()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.store == nil {
+		return nil
+	}
+	return m.store.Close()
+}
@@ -0,0 +1,132 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+// When the configuration is reloaded with new arguments for a plugin, its new
+// instance is set up while the old one still holds the store: opening it again
+// would fail to lock a bolt database, and compacting a second copy of a lease
+// file would lose the leases the old instance appends. The old instance hands
+// its store over instead (see Maintainer.Handover), for Open to return it to
+// the new instance. Stores are only shared during that handover, and closed
+// once both instances are.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// sharedLock protects handedOver and the reference counts of the stores
+	sharedLock sync.Mutex
+	// handedOver maps the absolute path of the stores being handed over to
+	// them
+	handedOver = make(map[string]*sharedStore)
+)
+
+// sharedStore is a store opened by Open, with the number of handles to it
+type sharedStore struct {
+	LeaseStore
+	backend string
+	path    string
+	refs    int
+}
+
+// handle is a reference to a store, closing it releases the reference
+type handle struct {
+	*sharedStore
+	once sync.Once
+}
+
+// Close closes the store once no other handle uses it
+func (h *handle) Close() error {
+	var err error
+	h.once.Do(func() {
+		sharedLock.Lock()
+		defer sharedLock.Unlock()
+		h.refs--
+		if h.refs > 0 {
+			return
+		}
+		if handedOver[h.path] == h.sharedStore {
+			delete(handedOver, h.path)
+		}
+		err = h.LeaseStore.Close()
+	})
+	return err
+}
+
+// compactHandle is a handle to a store which can be compacted
+type compactHandle struct {
+	*handle
+}
+
+func (h compactHandle) Compact() error {
+	return h.LeaseStore.(Compacter).Compact()
+}
+
+// newHandle returns a new reference to s. It must be called with sharedLock
+// held
+func newHandle(s *sharedStore) LeaseStore {
+	s.refs++
+	h := &handle{sharedStore: s}
+	if _, ok := s.LeaseStore.(Compacter); ok {
+		return compactHandle{h}
+	}
+	return h
+}
+
+// sharedOf returns the store behind a store returned by Open, if it is one
+func sharedOf(store LeaseStore) *sharedStore {
+	switch h := store.(type) {
+	case *handle:
+		return h.sharedStore
+	case compactHandle:
+		return h.sharedStore
+	}
+	return nil
+}
+
+// openShared returns the store handed over at path if there is one, or else
+// opens it with open
+func openShared(backend, path string, open func(string) (LeaseStore, error)) (LeaseStore, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	sharedLock.Lock()
+	defer sharedLock.Unlock()
+	if s, ok := handedOver[abs]; ok {
+		if s.backend != backend {
+			return nil, fmt.Errorf("%s is being handed over with the %s backend", path, s.backend)
+		}
+		delete(handedOver, abs)
+		return newHandle(s), nil
+	}
+	store, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newHandle(&sharedStore{LeaseStore: store, backend: backend, path: abs}), nil
+}
+
+// handOver makes the next Open of the path of store return it, until the
+// returned function is called
+func handOver(store LeaseStore) (withdraw func()) {
+	s := sharedOf(store)
+	if s == nil {
+		return func() {}
+	}
+	sharedLock.Lock()
+	handedOver[s.path] = s
+	sharedLock.Unlock()
+	return func() {
+		sharedLock.Lock()
+		defer sharedLock.Unlock()
+		if handedOver[s.path] == s {
+			delete(handedOver, s.path)
+		}
+	}
+}
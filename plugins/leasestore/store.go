@@ -0,0 +1,105 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package leasestore provides the persistence layer shared by the plugins
+// keeping leases, and its implementations.
+// Leases are indexed by the address or prefix they bind, which can only be
+// leased to a single client at a time. Plugins keep their own in-memory view
+// of the leases and use the store to persist it across restarts.
+package leasestore
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Lease is a binding of an address or prefix to a client
+type Lease struct {
+	// Owner identifies the client holding the lease. Its format is up to the
+	// plugin using the store (hardware address, DUID, ...) but it can't
+	// contain whitespace
+	Owner string
+	// Addr is the leased prefix, or address with a full-length mask
+	Addr net.IPNet
+	// Expires is the end of the lease
+	Expires time.Time
+}
+
+// LeaseStore is the interface to a persistent lease storage backend.
+// Implementations must be safe for concurrent use
+type LeaseStore interface {
+	// Load returns the lease for the given address, or ErrNotFound if there
+	// is none
+	Load(addr net.IPNet) (*Lease, error)
+	// Upsert stores a lease, replacing any lease for the same address
+	Upsert(lease *Lease) error
+	// Delete removes the lease for the given address. Deleting an address
+	// that isn't leased is not an error
+	Delete(addr net.IPNet) error
+	// Iterate calls fn for each stored lease, in no particular order. It stops
+	// at and returns the first error returned by fn
+	Iterate(fn func(*Lease) error) error
+	// Close flushes and releases the store, which can't be used afterwards
+	Close() error
+}
+
+// Compacter is implemented by stores that accumulate stale data over time
+// and can be asked to get rid of it
+type Compacter interface {
+	Compact() error
+}
+
+// ErrNotFound is returned by LeaseStore.Load when there is no lease for the
+// requested address
+var ErrNotFound = errors.New("lease not found")
+
+// Backend names accepted by Open
+const (
+	BackendFile = "file"
+	BackendBolt = "bolt"
+)
+
+// Open opens the store at path with the named backend. A store handed over
+// by the plugin instance being replaced on reload is returned instead, see
+// Maintainer.Handover
+func Open(backend, path string) (LeaseStore, error) {
+	switch backend {
+	case BackendFile:
+		return openShared(backend, path, func(path string) (LeaseStore, error) { return NewFileStore(path) })
+	case BackendBolt:
+		return openShared(backend, path, func(path string) (LeaseStore, error) { return NewBoltStore(path) })
+	default:
+		return nil, fmt.Errorf("unknown lease storage backend %q, want one of %s, %s", backend, BackendFile, BackendBolt)
+	}
+}
+
+// HostNet returns the network containing only the given address
+func HostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+	return net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
+
+// key returns the canonical form of an address, used to index leases
+func key(addr net.IPNet) string {
+	if ip4 := addr.IP.To4(); ip4 != nil && len(addr.Mask) == net.IPv4len {
+		addr.IP = ip4
+	}
+	return addr.String()
+}
+
+// checkLease validates a lease before it gets stored
+func checkLease(lease *Lease) error {
+	if lease.Owner == "" || strings.ContainsAny(lease.Owner, " \t\r\n") {
+		return fmt.Errorf("invalid lease owner %q", lease.Owner)
+	}
+	if _, bits := lease.Addr.Mask.Size(); bits == 0 || lease.Addr.IP == nil {
+		return fmt.Errorf("invalid leased address %v", lease.Addr)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackends runs the same sequence of operations on every backend, and
+// checks they persist across reopening the store
+func TestBackends(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "coredhcptest")
+			if err != nil {
+				t.Skipf("Could not setup file-based test: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "leases")
+
+			s, err := Open(backend, path)
+			require.NoError(t, err)
+
+			expire := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+			_, prefix, _ := net.ParseCIDR("2001:db8::/56")
+			leases := []Lease{
+				{"02:00:00:00:00:00", HostNet(net.IPv4(10, 0, 0, 0)), expire},
+				{"02:00:00:00:00:01", HostNet(net.IPv4(10, 0, 0, 1)), expire},
+				{"00010001aabbccddeeff", *prefix, expire},
+			}
+			for i := range leases {
+				require.NoError(t, s.Upsert(&leases[i]))
+			}
+			assert.Error(t, s.Upsert(&Lease{Owner: "has space", Addr: leases[0].Addr}), "Invalid owner was accepted")
+
+			// Replace and delete
+			leases[0].Expires = expire.Add(time.Hour)
+			require.NoError(t, s.Upsert(&leases[0]))
+			require.NoError(t, s.Delete(leases[1].Addr))
+			require.NoError(t, s.Delete(leases[1].Addr), "Deleting twice should be a no-op")
+
+			check := func(s LeaseStore) {
+				l, err := s.Load(leases[0].Addr)
+				require.NoError(t, err)
+				assert.True(t, l.Expires.Equal(leases[0].Expires))
+				assert.Equal(t, leases[0].Owner, l.Owner)
+				_, err = s.Load(leases[1].Addr)
+				assert.Equal(t, ErrNotFound, err)
+				l, err = s.Load(*prefix)
+				require.NoError(t, err)
+				assert.Equal(t, leases[2].Owner, l.Owner)
+
+				var owners []string
+				require.NoError(t, s.Iterate(func(l *Lease) error {
+					owners = append(owners, l.Owner)
+					return nil
+				}))
+				assert.ElementsMatch(t, []string{leases[0].Owner, leases[2].Owner}, owners)
+
+				stop := errors.New("stop")
+				assert.Equal(t, stop, s.Iterate(func(*Lease) error { return stop }))
+			}
+			check(s)
+			require.NoError(t, s.Close())
+
+			s, err = Open(backend, path)
+			require.NoError(t, err)
+			defer s.Close()
+			check(s)
+		})
+	}
+
+	_, err := Open("nosuchbackend", "leases")
+	assert.Error(t, err)
+}
+
+// compactCounter is a store counting its compactions
+type compactCounter struct {
+	LeaseStore
+	compactions chan struct{}
+	closed      bool
+}
+
+func (c *compactCounter) Compact() error {
+	c.compactions <- struct{}{}
+	return nil
+}
+
+func (c *compactCounter) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestMaintain(t *testing.T) {
+	var lock sync.Mutex
+	store := &compactCounter{compactions: make(chan struct{})}
+	sweeps := make(chan time.Time)
+	m := Maintain(log, store, &lock, func(now time.Time) int {
+		sweeps <- now
+		return 1
+	}, time.Millisecond, time.Millisecond)
+	<-sweeps
+	<-store.compactions
+	<-sweeps
+
+	closed := make(chan error)
+	go func() { closed <- m.Close() }()
+	// Let the maintenance return if it's blocked on a sweep or compaction
+	for done := false; !done; {
+		select {
+		case <-sweeps:
+		case <-store.compactions:
+		case err := <-closed:
+			require.NoError(t, err)
+			done = true
+		}
+	}
+	assert.True(t, store.closed, "Store not closed")
+
+	// Without a store, only the sweeps run
+	m = Maintain(log, nil, &lock, func(now time.Time) int { return 0 }, time.Millisecond, time.Millisecond)
+	assert.NoError(t, m.Close())
+}
+
+// TestHandover checks a store handed over, like by the old instance of a
+// plugin on reload, is shared with the next Open of its path until both are
+// closed
+func TestHandover(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "coredhcptest")
+			if err != nil {
+				t.Skipf("Could not setup file-based test: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "leases")
+			lease := Lease{"02:00:00:00:00:00", HostNet(net.IPv4(10, 0, 0, 0)), time.Now().Add(time.Hour)}
+
+			var lock sync.Mutex
+			old, err := Open(backend, path)
+			require.NoError(t, err)
+			require.NoError(t, old.Upsert(&lease))
+			sweeps := make(chan struct{}, 1)
+			m := Maintain(log, old, &lock, func(time.Time) int {
+				select {
+				case sweeps <- struct{}{}:
+				default:
+				}
+				return 0
+			}, time.Millisecond, time.Millisecond)
+
+			done := m.Handover()
+			lock.Lock()
+			assert.True(t, m.HandedOver())
+			lock.Unlock()
+			// Drain a sweep that ran before the handover
+			select {
+			case <-sweeps:
+			default:
+			}
+			s, err := Open(backend, path)
+			require.NoError(t, err, "Store not handed over")
+			_, isCompacter := old.(Compacter)
+			_, ok := s.(Compacter)
+			assert.Equal(t, isCompacter, ok)
+			done(true)
+			select {
+			case <-sweeps:
+				t.Error("Maintenance of the retired instance still runs")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			require.NoError(t, m.Close())
+			l, err := s.Load(lease.Addr)
+			require.NoError(t, err, "Store closed with its old user")
+			assert.Equal(t, lease.Owner, l.Owner)
+			require.NoError(t, s.Upsert(&Lease{"02:00:00:00:00:01", HostNet(net.IPv4(10, 0, 0, 1)), lease.Expires}))
+
+			// A reload failing resumes the maintenance, and the store isn't
+			// shared with later opens
+			m = Maintain(log, s, &lock, func(time.Time) int {
+				select {
+				case sweeps <- struct{}{}:
+				default:
+				}
+				return 0
+			}, time.Millisecond, 0)
+			m.Handover()(false)
+			lock.Lock()
+			assert.False(t, m.HandedOver())
+			lock.Unlock()
+			<-sweeps
+			if backend == BackendBolt {
+				_, err = Open(backend, path)
+				assert.Error(t, err, "Store shared outside of a handover")
+			}
+			require.NoError(t, m.Close())
+
+			// Once closed by all its users, the store is really closed
+			s, err = Open(backend, path)
+			require.NoError(t, err)
+			defer s.Close()
+			count := 0
+			require.NoError(t, s.Iterate(func(*Lease) error {
+				count++
+				return nil
+			}))
+			assert.Equal(t, 2, count)
+		})
+	}
+}
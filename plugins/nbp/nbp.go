@@ -114,7 +114,7 @@ func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4,
 func (p pluginStateV6) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	if p.opt59 == nil {
 		// nothing to do
-		return resp, true
+		return resp, false
 	}
 	decap, err := req.GetInnerMessage()
 	if err != nil {
@@ -134,13 +134,13 @@ func (p pluginStateV6) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		}
 	}
 	p.log.Debugf("Added NBP %s to request", p.opt59)
-	return resp, true
+	return resp, false
 }
 
 func (p pluginStateV4) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	if p.opt67 == nil {
 		// nothing to do
-		return resp, true
+		return resp, false
 	}
 	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && p.opt66 != nil {
 		resp.Options.Update(*p.opt66)
@@ -150,5 +150,5 @@ func (p pluginStateV4) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 		resp.Options.Update(*p.opt67)
 		p.log.Debugf("Added NBP %s to request", p.opt67)
 	}
-	return resp, true
+	return resp, false
 }
@@ -0,0 +1,65 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Options holds the optional `key=value` arguments that some plugins accept
+// after their positional arguments. The accessors remove the options they
+// read, so that Check can report the ones that weren't recognized
+type Options map[string]string
+
+// ParseOptions parses a list of `key=value` arguments
+func ParseOptions(args []string) (Options, error) {
+	opts := make(Options, len(args))
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid optional argument %q, want key=value", arg)
+		}
+		if _, ok := opts[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate optional argument %q", kv[0])
+		}
+		opts[kv[0]] = kv[1]
+	}
+	return opts, nil
+}
+
+// String returns the value of the given option, or def if it isn't set
+func (o Options) String(key, def string) string {
+	v, ok := o[key]
+	if !ok {
+		return def
+	}
+	delete(o, key)
+	return v
+}
+
+// Duration parses the given option as a non-negative duration, or returns
+// def if it isn't set
+func (o Options) Duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	delete(o, key)
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s duration: %v", key, v)
+	}
+	return d, nil
+}
+
+// Check returns an error if any option hasn't been read
+func (o Options) Check() error {
+	for k := range o {
+		return fmt.Errorf("unknown optional argument %q", k)
+	}
+	return nil
+}
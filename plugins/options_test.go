@@ -0,0 +1,40 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"grace=1h", "sweep=30s", "backend=bolt"})
+	require.NoError(t, err)
+	assert.Equal(t, Options{"grace": "1h", "sweep": "30s", "backend": "bolt"}, opts)
+
+	grace, err := opts.Duration("grace", 0)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, grace)
+	def, err := opts.Duration("unset", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, def)
+	assert.Equal(t, "bolt", opts.String("backend", "file"))
+	assert.Equal(t, "file", opts.String("unset", "file"))
+
+	assert.Error(t, opts.Check(), "Unread option not reported")
+	_, err = opts.Duration("sweep", 0)
+	require.NoError(t, err)
+	assert.NoError(t, opts.Check())
+
+	_, err = ParseOptions([]string{"grace"})
+	assert.Error(t, err)
+	_, err = ParseOptions([]string{"grace=1h", "grace=2h"})
+	assert.Error(t, err)
+	_, err = Options{"grace": "-1s"}.Duration("grace", 0)
+	assert.Error(t, err)
+}
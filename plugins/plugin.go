@@ -5,23 +5,41 @@
 package plugins
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
 
 	"github.com/insei/coredhcp/config"
 	"github.com/insei/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/sirupsen/logrus"
 )
 
 // Plugin represents a plugin object.
 // Setup6 and Setup4 are the setup functions for DHCPv6 and DHCPv4 handlers
 // respectively. Both setup functions can be nil.
+// Init6 and Init4 are alternative setup functions for plugins which hold
+// resources (files, goroutines, sockets...) that must be released when the
+// server stops. When set, they are used instead of Setup6 and Setup4.
+// InitContext6 and InitContext4 are like Init6 and Init4, for handlers which
+// receive the context of each request. When set, they are used instead of all
+// the others.
 type Plugin struct {
-	Name   string
-	Setup6 SetupFunc6
-	Setup4 SetupFunc4
+	Name         string
+	Setup6       SetupFunc6
+	Setup4       SetupFunc4
+	Init6        InitFunc6
+	Init4        InitFunc4
+	InitContext6 InitContextFunc6
+	InitContext4 InitContextFunc4
 }
 
-// RegisteredPlugins maps a plugin name to a Plugin instance.
+// RegisteredPlugins maps a plugin name to a Plugin instance. It holds the
+// plugins of DefaultRegistry.
 var RegisteredPlugins = make(map[string]*Plugin)
 
 // SetupFunc6 defines a plugin setup function for DHCPv6
@@ -30,83 +48,539 @@ type SetupFunc6 func(serverLogger logrus.FieldLogger, args ...string) (handler.H
 // SetupFunc4 defines a plugin setup function for DHCPv6
 type SetupFunc4 func(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, error)
 
-// RegisterPlugin registers a plugin.
+// InitFunc6 defines a plugin setup function for DHCPv6, which also returns
+// what to close when the plugin instance isn't used anymore
+type InitFunc6 func(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, io.Closer, error)
+
+// InitFunc4 defines a plugin setup function for DHCPv4, which also returns
+// what to close when the plugin instance isn't used anymore
+type InitFunc4 func(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error)
+
+// InitContextFunc6 is like InitFunc6, for handlers which receive the context
+// of each request
+type InitContextFunc6 func(serverLogger logrus.FieldLogger, args ...string) (handler.ContextHandler6, io.Closer, error)
+
+// InitContextFunc4 is like InitFunc4, for handlers which receive the context
+// of each request
+type InitContextFunc4 func(serverLogger logrus.FieldLogger, args ...string) (handler.ContextHandler4, io.Closer, error)
+
+// RegisterPlugin registers a plugin in DefaultRegistry. It panics if a plugin
+// with the same name is already registered, use a Registry to handle that.
 func RegisterPlugin(logger logrus.FieldLogger, plugin *Plugin) error {
 	if plugin == nil {
 		return errors.New("cannot register nil plugin")
 	}
 	logger.Printf("Registering plugin '%s'", plugin.Name)
-	if _, ok := RegisteredPlugins[plugin.Name]; ok {
-		// TODO this highlights that asking the plugins to register themselves
-		// is not the right approach. Need to register them in the main program.
-		logger.Panicf("Plugin '%s' is already registered", plugin.Name)
+	if err := DefaultRegistry.Register(plugin); err != nil {
+		logger.Panic(err)
+	}
+	return nil
+}
+
+// Reloader is implemented by plugin instances, as returned by Init6 and Init4,
+// which can refresh their state (e.g. re-read a file) when the server
+// configuration is reloaded. Instances whose arguments didn't change are kept
+// across reloads, and have their Reload method called
+type Reloader interface {
+	Reload() error
+}
+
+// Handover is implemented by plugin instances holding resources that the
+// instance replacing them on reload needs, like a lease file which can't be
+// opened twice, nor written by two allocators. Before setting up the new
+// instances, Reload calls Handover on the instances of the previous chain
+// that the new configuration doesn't reuse, which stop their background work
+// and release their resources to the setup of their replacement. Once the
+// reload is over, the returned function is called with whether the instance
+// was retired, or is still in use because the reload failed
+type Handover interface {
+	Handover() (done func(retired bool))
+}
+
+// instance is a plugin set up with some arguments
+type instance struct {
+	name   string
+	args   []string
+	v6     bool
+	h4     handler.ContextHandler4
+	h6     handler.ContextHandler6
+	closer io.Closer
+	// refs counts the chains using the instance, it is protected by instancesLock
+	refs int
+}
+
+// instancesLock protects the reference counts of all plugin instances
+var instancesLock sync.Mutex
+
+// setupLock serializes the loading of plugins, so that the resources handed
+// over on the reload of a server only go to the new instances of that server
+var setupLock sync.Mutex
+
+// Chain holds the handlers of the plugins loaded from a configuration, in
+// order, along with the plugin instances they belong to
+type Chain struct {
+	Handlers4 []NamedHandler4
+	Handlers6 []NamedHandler6
+	// Subnets4 are the DHCPv4 subnets configured with their own plugins
+	Subnets4 []Subnet4
+	// Links6 are the DHCPv6 links configured with their own plugins
+	Links6 []Link6
+	// Classes4 and Classes6 are the client classes configured with their own
+	// plugins, in configuration order
+	Classes4 []Class4
+	Classes6 []Class6
+	// Listeners4 and Listeners6 are the handlers of the listen addresses
+	// configured with their own plugins, keyed by address as formatted by
+	// net.UDPAddr.String
+	Listeners4 map[string][]NamedHandler4
+	Listeners6 map[string][]NamedHandler6
+	// instances are in loading order
+	instances []*instance
+	registry  *Registry
+	log       logrus.FieldLogger
+}
+
+// NamedHandler6 is the handler of a DHCPv6 plugin instance, along with the name
+// of the plugin
+type NamedHandler6 struct {
+	Name    string
+	Handler handler.ContextHandler6
+}
+
+// NamedHandler4 is the handler of a DHCPv4 plugin instance, along with the name
+// of the plugin
+type NamedHandler4 struct {
+	Name    string
+	Handler handler.ContextHandler4
+}
+
+// Subnet4 is a DHCPv4 subnet with its own plugins
+type Subnet4 struct {
+	Net net.IPNet
+	// Handlers is the whole chain for requests from the subnet: the handlers
+	// of the server-wide plugins, followed by the subnet's own
+	Handlers []NamedHandler4
+}
+
+// Link6 is a DHCPv6 link with its own plugins
+type Link6 struct {
+	// Net is the prefix of the link, with a nil IP if unset
+	Net net.IPNet
+	// InterfaceID is the interface-id relays identify the link with, if not
+	// empty
+	InterfaceID string
+	// Handlers is the whole chain for requests from the link: the handlers of
+	// the server-wide plugins, followed by the link's own
+	Handlers []NamedHandler6
+}
+
+// Class6 is a DHCPv6 client class with its own plugins
+type Class6 struct {
+	Name  string
+	Match config.ClassMatch
+	// Handlers are only the class's own handlers, run after the others for
+	// the requests in the class
+	Handlers []NamedHandler6
+}
+
+// Class4 is a DHCPv4 client class with its own plugins
+type Class4 struct {
+	Name  string
+	Match config.ClassMatch
+	// Handlers are only the class's own handlers, run after the others for
+	// the requests in the class
+	Handlers []NamedHandler4
+}
+
+// Close releases the resources held by the plugin instances of the chain, in
+// the reverse order of loading. Instances also used by another chain are left
+// open until that chain is closed too. The handlers must not be used anymore
+// once Close is called. It returns the first error encountered, if any
+func (c *Chain) Close() error {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	var firstErr error
+	for i := len(c.instances) - 1; i >= 0; i-- {
+		inst := c.instances[i]
+		inst.refs--
+		if inst.refs > 0 || inst.closer == nil {
+			continue
+		}
+		if err := inst.closer.Close(); err != nil {
+			c.log.Errorf("Could not close plugin `%s`: %v", inst.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	c.instances = nil
+	return firstErr
+}
+
+// add adds an instance to the chain
+func (c *Chain) add(inst *instance) {
+	instancesLock.Lock()
+	inst.refs++
+	instancesLock.Unlock()
+	c.instances = append(c.instances, inst)
+}
+
+// reusable returns an instance of prev with the given configuration that
+// isn't reused yet, if any, and marks it as reused
+func reusable(prev *Chain, v6 bool, conf config.PluginConfig, reused map[*instance]bool) *instance {
+	if prev == nil {
+		return nil
+	}
+	for _, inst := range prev.instances {
+		if inst.v6 != v6 || inst.name != conf.Name || reused[inst] || len(inst.args) != len(conf.Args) {
+			continue
+		}
+		same := true
+		for i := range inst.args {
+			if inst.args[i] != conf.Args[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			reused[inst] = true
+			return inst
+		}
 	}
-	RegisteredPlugins[plugin.Name] = plugin
 	return nil
 }
 
-// LoadPlugins reads a Config object and loads the plugins as specified in the
+// handOver calls Handover on the instances of prev that loading conf won't
+// reuse, and returns the function to call once the reload is over
+func handOver(prev *Chain, conf *config.Config) (done func(reloaded bool)) {
+	if prev == nil {
+		return func(bool) {}
+	}
+	// Find the reused instances the same way loading does
+	reused := make(map[*instance]bool)
+	mark := func(v6 bool, confs []config.PluginConfig) {
+		for _, pluginConf := range confs {
+			reusable(prev, v6, pluginConf, reused)
+		}
+	}
+	if conf.Server6 != nil {
+		mark(true, conf.Server6.Plugins)
+		for _, link := range conf.Server6.Links {
+			mark(true, link.Plugins)
+		}
+		for _, listener := range conf.Server6.Listeners {
+			mark(true, listener.Plugins)
+		}
+		for _, class := range conf.Server6.Classes {
+			mark(true, class.Plugins)
+		}
+	}
+	if conf.Server4 != nil {
+		mark(false, conf.Server4.Plugins)
+		for _, subnet := range conf.Server4.Subnets {
+			mark(false, subnet.Plugins)
+		}
+		for _, listener := range conf.Server4.Listeners {
+			mark(false, listener.Plugins)
+		}
+		for _, class := range conf.Server4.Classes {
+			mark(false, class.Plugins)
+		}
+	}
+	var dones []func(bool)
+	for _, inst := range prev.instances {
+		if h, ok := inst.closer.(Handover); ok && !reused[inst] {
+			dones = append(dones, h.Handover())
+		}
+	}
+	return func(reloaded bool) {
+		for _, done := range dones {
+			done(reloaded)
+		}
+	}
+}
+
+// reload prepares an instance kept across a configuration reload
+func reload(serverLogger logrus.FieldLogger, inst *instance) error {
+	serverLogger.Printf("DHCPv%d: keeping plugin `%s`", map[bool]int{true: 6, false: 4}[inst.v6], inst.name)
+	if r, ok := inst.closer.(Reloader); ok {
+		if err := r.Reload(); err != nil {
+			return fmt.Errorf("could not reload plugin %s: %w", inst.name, err)
+		}
+	}
+	return nil
+}
+
+// Load reads a Config object and loads the plugins as specified in the
 // `plugins` section, in order. For a plugin to be available, it must have been
 // previously registered with plugins.RegisterPlugin. This is normally done at
 // plugin import time.
-// This function returns the list of loaded v6 plugins, the list of loaded v4
-// plugins, and an error if any.
-func LoadPlugins(serverLogger logrus.FieldLogger, conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
+// If loading fails, the plugins loaded so far are closed.
+func Load(serverLogger logrus.FieldLogger, conf *config.Config) (*Chain, error) {
+	return DefaultRegistry.Load(serverLogger, conf)
+}
+
+// Reload is like Load, but the instances of the plugins of prev that have the
+// same name and arguments in the new configuration are reused rather than set
+// up anew, after calling their Reload hook, if any. The others are handed over
+// to their replacement, if they implement Handover. prev can still be used
+// until it is closed
+func Reload(serverLogger logrus.FieldLogger, conf *config.Config, prev *Chain) (*Chain, error) {
+	return DefaultRegistry.Reload(serverLogger, conf, prev)
+}
+
+// Reload is like the Reload function, with the plugins of the registry
+func (r *Registry) Reload(serverLogger logrus.FieldLogger, conf *config.Config, prev *Chain) (*Chain, error) {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+	done := handOver(prev, conf)
+	chain, err := r.load(serverLogger, conf, prev)
+	done(err == nil)
+	return chain, err
+}
+
+// load loads the plugins of conf, reusing those of prev when possible
+func (r *Registry) load(serverLogger logrus.FieldLogger, conf *config.Config, prev *Chain) (*Chain, error) {
 	serverLogger.Print("Loading plugins...")
-	handlers4 := make([]handler.Handler4, 0)
-	handlers6 := make([]handler.Handler6, 0)
+	chain := &Chain{
+		Handlers4: make([]NamedHandler4, 0),
+		Handlers6: make([]NamedHandler6, 0),
+		registry:  r,
+		log:       serverLogger,
+	}
+	reused := make(map[*instance]bool)
 
 	if conf.Server6 == nil && conf.Server4 == nil {
-		return nil, nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
+		return nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
 	}
 
 	// now load the plugins. We need to call its setup function with
 	// the arguments extracted above. The setup function is mapped in
-	// plugins.RegisteredPlugins .
-
-	// Load DHCPv6 plugins.
+	// the registry.
+	var err error
 	if conf.Server6 != nil {
-		for _, pluginConf := range conf.Server6.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
-				serverLogger.Printf("DHCPv6: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup6 == nil {
-					serverLogger.Warningf("DHCPv6: plugin `%s` has no setup function for DHCPv6", pluginConf.Name)
-					continue
-				}
-				h6, err := plugin.Setup6(serverLogger, pluginConf.Args...)
-				if err != nil {
-					return nil, nil, err
-				} else if h6 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
-				}
-				handlers6 = append(handlers6, h6)
-			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
-			}
-		}
-	}
-	// Load DHCPv4 plugins. Yes, duplicated code, there's not really much that
-	// can be deduplicated here.
+		chain.Handlers6, err = chain.load6(serverLogger, conf.Server6.Plugins, prev, reused)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		for i, link := range conf.Server6.Links {
+			serverLogger.Printf("DHCPv6: loading plugins of link #%d", i)
+			handlers, err := chain.load6(serverLogger, link.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
+			}
+			chain.Links6 = append(chain.Links6, Link6{
+				Net:         link.Net,
+				InterfaceID: link.InterfaceID,
+				Handlers:    append(chain.Handlers6[:len(chain.Handlers6):len(chain.Handlers6)], handlers...),
+			})
+		}
+		for i, listener := range conf.Server6.Listeners {
+			serverLogger.Printf("DHCPv6: loading plugins of listen entry #%d", i)
+			handlers, err := chain.load6(serverLogger, listener.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
+			}
+			if chain.Listeners6 == nil {
+				chain.Listeners6 = make(map[string][]NamedHandler6)
+			}
+			for _, addr := range listener.Addresses {
+				chain.Listeners6[addr.String()] = handlers
+			}
+		}
+		for _, class := range conf.Server6.Classes {
+			serverLogger.Printf("DHCPv6: loading plugins of class %s", class.Name)
+			handlers, err := chain.load6(serverLogger, class.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
+			}
+			chain.Classes6 = append(chain.Classes6, Class6{Name: class.Name, Match: class.Match, Handlers: handlers})
+		}
+	}
 	if conf.Server4 != nil {
-		for _, pluginConf := range conf.Server4.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
-				serverLogger.Printf("DHCPv4: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup4 == nil {
-					serverLogger.Warningf("DHCPv4: plugin `%s` has no setup function for DHCPv4", pluginConf.Name)
-					continue
-				}
-				h4, err := plugin.Setup4(serverLogger, pluginConf.Args...)
-				if err != nil {
-					return nil, nil, err
-				} else if h4 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
-				}
-				handlers4 = append(handlers4, h4)
-			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
+		chain.Handlers4, err = chain.load4(serverLogger, conf.Server4.Plugins, prev, reused)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		for _, subnet := range conf.Server4.Subnets {
+			serverLogger.Printf("DHCPv4: loading plugins of subnet %s", &subnet.Net)
+			handlers, err := chain.load4(serverLogger, subnet.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
+			}
+			chain.Subnets4 = append(chain.Subnets4, Subnet4{
+				Net:      subnet.Net,
+				Handlers: append(chain.Handlers4[:len(chain.Handlers4):len(chain.Handlers4)], handlers...),
+			})
+		}
+		for i, listener := range conf.Server4.Listeners {
+			serverLogger.Printf("DHCPv4: loading plugins of listen entry #%d", i)
+			handlers, err := chain.load4(serverLogger, listener.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
+			}
+			if chain.Listeners4 == nil {
+				chain.Listeners4 = make(map[string][]NamedHandler4)
+			}
+			for _, addr := range listener.Addresses {
+				chain.Listeners4[addr.String()] = handlers
+			}
+		}
+		for _, class := range conf.Server4.Classes {
+			serverLogger.Printf("DHCPv4: loading plugins of class %s", class.Name)
+			handlers, err := chain.load4(serverLogger, class.Plugins, prev, reused)
+			if err != nil {
+				chain.Close()
+				return nil, err
 			}
+			chain.Classes4 = append(chain.Classes4, Class4{Name: class.Name, Match: class.Match, Handlers: handlers})
 		}
 	}
 
+	return chain, nil
+}
+
+// load6 loads a list of DHCPv6 plugins into the chain, and returns their
+// handlers
+func (c *Chain) load6(serverLogger logrus.FieldLogger, confs []config.PluginConfig, prev *Chain, reused map[*instance]bool) ([]NamedHandler6, error) {
+	handlers := make([]NamedHandler6, 0, len(confs))
+	for _, pluginConf := range confs {
+		if inst := reusable(prev, true, pluginConf, reused); inst != nil {
+			c.add(inst)
+			if err := reload(serverLogger, inst); err != nil {
+				return nil, err
+			}
+			handlers = append(handlers, NamedHandler6{Name: inst.name, Handler: inst.h6})
+			continue
+		}
+		plugin := c.registry.Get(pluginConf.Name)
+		if plugin == nil {
+			return nil, config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
+		}
+		serverLogger.Printf("DHCPv6: loading plugin `%s`", pluginConf.Name)
+		inst := &instance{name: pluginConf.Name, args: pluginConf.Args, v6: true}
+		var (
+			h   handler.Handler6
+			err error
+		)
+		switch {
+		case plugin.InitContext6 != nil:
+			inst.h6, inst.closer, err = plugin.InitContext6(serverLogger, pluginConf.Args...)
+		case plugin.Init6 != nil:
+			h, inst.closer, err = plugin.Init6(serverLogger, pluginConf.Args...)
+		case plugin.Setup6 != nil:
+			h, err = plugin.Setup6(serverLogger, pluginConf.Args...)
+		default:
+			serverLogger.Warningf("DHCPv6: plugin `%s` has no setup function for DHCPv6", pluginConf.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			inst.h6 = handler.WithContext6(h)
+		}
+		c.add(inst)
+		if inst.h6 == nil {
+			return nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
+		}
+		handlers = append(handlers, NamedHandler6{Name: inst.name, Handler: inst.h6})
+	}
+	return handlers, nil
+}
+
+// load4 behaves like load6, but for DHCPv4 plugins. Yes, duplicated code,
+// there's not really much that can be deduplicated here.
+func (c *Chain) load4(serverLogger logrus.FieldLogger, confs []config.PluginConfig, prev *Chain, reused map[*instance]bool) ([]NamedHandler4, error) {
+	handlers := make([]NamedHandler4, 0, len(confs))
+	for _, pluginConf := range confs {
+		if inst := reusable(prev, false, pluginConf, reused); inst != nil {
+			c.add(inst)
+			if err := reload(serverLogger, inst); err != nil {
+				return nil, err
+			}
+			handlers = append(handlers, NamedHandler4{Name: inst.name, Handler: inst.h4})
+			continue
+		}
+		plugin := c.registry.Get(pluginConf.Name)
+		if plugin == nil {
+			return nil, config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
+		}
+		serverLogger.Printf("DHCPv4: loading plugin `%s`", pluginConf.Name)
+		inst := &instance{name: pluginConf.Name, args: pluginConf.Args}
+		var (
+			h   handler.Handler4
+			err error
+		)
+		switch {
+		case plugin.InitContext4 != nil:
+			inst.h4, inst.closer, err = plugin.InitContext4(serverLogger, pluginConf.Args...)
+		case plugin.Init4 != nil:
+			h, inst.closer, err = plugin.Init4(serverLogger, pluginConf.Args...)
+		case plugin.Setup4 != nil:
+			h, err = plugin.Setup4(serverLogger, pluginConf.Args...)
+		default:
+			serverLogger.Warningf("DHCPv4: plugin `%s` has no setup function for DHCPv4", pluginConf.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			inst.h4 = handler.WithContext4(h)
+		}
+		c.add(inst)
+		if inst.h4 == nil {
+			return nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
+		}
+		handlers = append(handlers, NamedHandler4{Name: inst.name, Handler: inst.h4})
+	}
+	return handlers, nil
+}
+
+// LoadPlugins is like Load, but only returns the handlers of the loaded
+// plugins: the list of loaded v4 plugins, the list of loaded v6 plugins, and
+// an error if any. The resources held by the plugins are never released, use
+// Load for that. The handlers run with an empty request context.
+func LoadPlugins(serverLogger logrus.FieldLogger, conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
+	return DefaultRegistry.LoadPlugins(serverLogger, conf)
+}
+
+// LoadPlugins is like the LoadPlugins function, with the plugins of the
+// registry
+func (r *Registry) LoadPlugins(serverLogger logrus.FieldLogger, conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
+	chain, err := r.Load(serverLogger, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	handlers4 := make([]handler.Handler4, 0, len(chain.Handlers4))
+	for _, h := range chain.Handlers4 {
+		h := h.Handler
+		handlers4 = append(handlers4, func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			resp, res := h(handler.NewContext(context.Background(), serverLogger), req, resp)
+			if res.Action == handler.ActionDrop {
+				return nil, true
+			}
+			return resp, res.Action == handler.ActionRespond
+		})
+	}
+	handlers6 := make([]handler.Handler6, 0, len(chain.Handlers6))
+	for _, h := range chain.Handlers6 {
+		h := h.Handler
+		handlers6 = append(handlers6, func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+			resp, res := h(handler.NewContext(context.Background(), serverLogger), req, resp)
+			if res.Action == handler.ActionDrop {
+				return nil, true
+			}
+			return resp, res.Action == handler.ActionRespond
+		})
+	}
 	return handlers4, handlers6, nil
 }
@@ -0,0 +1,295 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+// registerTestPlugin registers a plugin recording its instances being
+// closed, and failing to set up when given the "fail" argument
+func registerTestPlugin(t *testing.T, name string, closed *[]string) {
+	RegisteredPlugins[name] = &Plugin{
+		Name: name,
+		Init4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
+			if len(args) > 0 && args[0] == "fail" {
+				return nil, nil, errors.New("setup failed")
+			}
+			h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+			return h, closeFunc(func() error {
+				*closed = append(*closed, name)
+				return nil
+			}), nil
+		},
+	}
+	t.Cleanup(func() { delete(RegisteredPlugins, name) })
+}
+
+func TestLoadClose(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var closed []string
+	registerTestPlugin(t, "test_first", &closed)
+	registerTestPlugin(t, "test_second", &closed)
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_first"},
+		{Name: "test_second"},
+	}}}
+	chain, err := Load(log, conf)
+	require.NoError(t, err)
+	assert.Len(t, chain.Handlers4, 2)
+	require.NoError(t, chain.Close())
+	assert.Equal(t, []string{"test_second", "test_first"}, closed, "Plugins must be closed in reverse order")
+	require.NoError(t, chain.Close())
+	assert.Len(t, closed, 2, "Plugins closed twice")
+
+	// Plugins already loaded are closed when a later one fails
+	closed = nil
+	conf.Server4.Plugins[1].Args = []string{"fail"}
+	_, err = Load(log, conf)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"test_first"}, closed)
+}
+
+// reloadable is a closer recording its reloads
+type reloadable struct {
+	closeFunc
+	reloads *int
+}
+
+func (r reloadable) Reload() error {
+	*r.reloads++
+	return nil
+}
+
+func TestReloadReuse(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var closed []string
+	registerTestPlugin(t, "test_plain", &closed)
+	setups, reloads := 0, 0
+	RegisteredPlugins["test_reload"] = &Plugin{
+		Name: "test_reload",
+		Init4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
+			setups++
+			h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+			return h, reloadable{closeFunc(func() error {
+				closed = append(closed, "test_reload")
+				return nil
+			}), &reloads}, nil
+		},
+	}
+	t.Cleanup(func() { delete(RegisteredPlugins, "test_reload") })
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_reload", Args: []string{"a"}},
+		{Name: "test_plain", Args: []string{"a"}},
+	}}}
+	first, err := Load(log, conf)
+	require.NoError(t, err)
+	require.Equal(t, 1, setups)
+
+	// Unchanged instances are kept and reloaded, changed ones set up anew
+	conf = &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_reload", Args: []string{"a"}},
+		{Name: "test_plain", Args: []string{"b"}},
+	}}}
+	second, err := Reload(log, conf, first)
+	require.NoError(t, err)
+	assert.Equal(t, 1, setups, "Unchanged plugin was set up again")
+	assert.Equal(t, 1, reloads, "Kept plugin was not reloaded")
+
+	// Closing the previous chain only closes what the new one doesn't use
+	require.NoError(t, first.Close())
+	assert.Equal(t, []string{"test_plain"}, closed)
+	require.NoError(t, second.Close())
+	assert.Equal(t, []string{"test_plain", "test_plain", "test_reload"}, closed)
+}
+
+// handedOver is a closer recording its handovers in events
+type handedOver struct {
+	closeFunc
+	arg    string
+	events *[]string
+}
+
+func (h handedOver) Handover() func(retired bool) {
+	*h.events = append(*h.events, "handover "+h.arg)
+	return func(retired bool) {
+		*h.events = append(*h.events, fmt.Sprintf("done %s %v", h.arg, retired))
+	}
+}
+
+func TestReloadHandover(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var events []string
+	RegisteredPlugins["test_handover"] = &Plugin{
+		Name: "test_handover",
+		Init4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
+			if args[0] == "fail" {
+				return nil, nil, errors.New("setup failed")
+			}
+			events = append(events, "setup "+args[0])
+			h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+			return h, handedOver{closeFunc(func() error { return nil }), args[0], &events}, nil
+		},
+	}
+	t.Cleanup(func() { delete(RegisteredPlugins, "test_handover") })
+	conf := func(args ...string) *config.Config {
+		c := &config.Config{Server4: &config.ServerConfig{}}
+		for _, arg := range args {
+			c.Server4.Plugins = append(c.Server4.Plugins, config.PluginConfig{Name: "test_handover", Args: []string{arg}})
+		}
+		return c
+	}
+
+	first, err := Load(log, conf("a", "b"))
+	require.NoError(t, err)
+	defer first.Close()
+
+	// Only the replaced instances hand over, before their replacement is set up
+	events = nil
+	second, err := Reload(log, conf("a", "c"), first)
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, []string{"handover b", "setup c", "done b true"}, events)
+
+	// When the reload fails, the instances are still used
+	events = nil
+	_, err = Reload(log, conf("c", "fail"), second)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"handover a", "done a false"}, events)
+}
+
+func TestLoadSubnets(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var closed []string
+	registerTestPlugin(t, "test_server", &closed)
+	registerTestPlugin(t, "test_subnet", &closed)
+
+	conf := &config.Config{Server4: &config.ServerConfig{
+		Plugins: []config.PluginConfig{{Name: "test_server"}},
+		Subnets: []config.SubnetConfig{
+			{Net: net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(25, 32)}, Plugins: []config.PluginConfig{{Name: "test_subnet", Args: []string{"a"}}}},
+			{Net: net.IPNet{IP: net.IPv4(192, 0, 2, 128), Mask: net.CIDRMask(25, 32)}, Plugins: []config.PluginConfig{{Name: "test_subnet", Args: []string{"b"}}}},
+		},
+	}}
+	chain, err := Load(log, conf)
+	require.NoError(t, err)
+	assert.Len(t, chain.Handlers4, 1)
+	require.Len(t, chain.Subnets4, 2)
+	for _, subnet := range chain.Subnets4 {
+		assert.Len(t, subnet.Handlers, 2, "Subnet %s must run the server-wide and its own plugins", &subnet.Net)
+	}
+	require.NoError(t, chain.Close())
+	assert.Equal(t, []string{"test_subnet", "test_subnet", "test_server"}, closed)
+
+	// Plugins of all the subnets are closed when one fails
+	closed = nil
+	conf.Server4.Subnets[1].Plugins[0].Args = []string{"fail"}
+	_, err = Load(log, conf)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"test_subnet", "test_server"}, closed)
+}
+
+func TestLoadClasses(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var closed []string
+	registerTestPlugin(t, "test_server", &closed)
+	registerTestPlugin(t, "test_class", &closed)
+
+	conf := &config.Config{Server4: &config.ServerConfig{
+		Plugins: []config.PluginConfig{{Name: "test_server"}},
+		Classes: []config.ClassConfig{{
+			Name:    "pxe",
+			Match:   config.ClassMatch{VendorClass: "PXEClient"},
+			Plugins: []config.PluginConfig{{Name: "test_class"}, {Name: "test_class", Args: []string{"a"}}},
+		}},
+	}}
+	chain, err := Load(log, conf)
+	require.NoError(t, err)
+	assert.Len(t, chain.Handlers4, 1)
+	require.Len(t, chain.Classes4, 1)
+	assert.Equal(t, "pxe", chain.Classes4[0].Name)
+	assert.Equal(t, "PXEClient", chain.Classes4[0].Match.VendorClass)
+	assert.Len(t, chain.Classes4[0].Handlers, 2, "Classes must only hold their own plugins")
+	require.NoError(t, chain.Close())
+	assert.Equal(t, []string{"test_class", "test_class", "test_server"}, closed)
+}
+
+func TestLoadListeners(t *testing.T) {
+	log := logger.GetLogger("tests")
+	var closed []string
+	registerTestPlugin(t, "test_server", &closed)
+	registerTestPlugin(t, "test_listener", &closed)
+
+	lab := []net.UDPAddr{{IP: net.IPv4(192, 0, 2, 1), Port: 67}, {IP: net.IPv4(192, 0, 2, 2), Port: 67}}
+	conf := &config.Config{Server4: &config.ServerConfig{
+		Plugins:   []config.PluginConfig{{Name: "test_server"}},
+		Listeners: []config.ListenerConfig{{Addresses: lab, Plugins: []config.PluginConfig{{Name: "test_listener"}}}},
+	}}
+	chain, err := Load(log, conf)
+	require.NoError(t, err)
+	assert.Len(t, chain.Handlers4, 1)
+	require.Len(t, chain.Listeners4, 2)
+	for _, addr := range lab {
+		if assert.Len(t, chain.Listeners4[addr.String()], 1, "%s", &addr) {
+			assert.Equal(t, "test_listener", chain.Listeners4[addr.String()][0].Name)
+		}
+	}
+	require.NoError(t, chain.Close())
+	assert.Equal(t, []string{"test_listener", "test_server"}, closed)
+}
+
+func TestLoadContextHandlers(t *testing.T) {
+	log := logger.GetLogger("tests")
+	RegisteredPlugins["test_context"] = &Plugin{
+		Name: "test_context",
+		Setup4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, error) {
+			return nil, errors.New("InitContext4 must be preferred")
+		},
+		InitContext4: func(_ logrus.FieldLogger, args ...string) (handler.ContextHandler4, io.Closer, error) {
+			return func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+				ctx.Set("test_context.called", true)
+				return resp, handler.Continue
+			}, nil, nil
+		},
+	}
+	t.Cleanup(func() { delete(RegisteredPlugins, "test_context") })
+	var closed []string
+	registerTestPlugin(t, "test_plain", &closed)
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_context"},
+		{Name: "test_plain"},
+	}}}
+	chain, err := Load(log, conf)
+	require.NoError(t, err)
+	defer chain.Close()
+	require.Len(t, chain.Handlers4, 2)
+	ctx := handler.NewContext(context.Background(), log)
+	for _, h := range chain.Handlers4 {
+		h.Handler(ctx, nil, nil)
+	}
+	assert.Equal(t, "test_context", chain.Handlers4[0].Name)
+	called, _ := ctx.Get("test_context.called")
+	assert.Equal(t, true, called)
+}
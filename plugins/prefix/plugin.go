@@ -9,15 +9,25 @@
 // - prefix: The base prefix from which assigned prefixes are carved
 // - max: maximum size of the prefix delegated to clients. When a client requests a larger prefix
 // than this, this is the size of the offered prefix
+// followed by optional key=value arguments:
+// - leasefile: where delegations are stored across restarts. Without it they are only kept in memory
+// - backend: the lease storage backend, file or bolt (default: file)
+// - preferred: the preferred lifetime of delegated prefixes (default: 1h)
+// - valid: the valid lifetime of delegated prefixes, after which they expire (default: preferred)
+// - grace: how long an expired prefix is kept for its client before being reclaimed (default: 0s)
+// - sweep: how often expired prefixes are looked for (default: 1m)
+// - compact: how often the lease file is compacted, for the file backend (default: 1h)
 package prefix
 
-// FIXME: various settings will be hardcoded (default size, minimum size, lease times) pending a
-// better configuration system
+// FIXME: various settings will be hardcoded (default size, minimum size) pending a better
+// configuration system
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -33,46 +43,102 @@ import (
 	"github.com/insei/coredhcp/plugins"
 	"github.com/insei/coredhcp/plugins/allocators"
 	"github.com/insei/coredhcp/plugins/allocators/bitmap"
+	"github.com/insei/coredhcp/plugins/leasestore"
 )
 
 const pluginName = "prefix"
 
 // Plugin registers the prefix. Prefix delegation only exists for DHCPv6
 var Plugin = plugins.Plugin{
-	Name:   pluginName,
-	Setup6: setup6,
+	Name:  pluginName,
+	Init6: setup6,
 }
 
-const leaseDuration = 3600 * time.Second
+// defaultLifetime is the preferred lifetime when the `preferred` argument isn't given
+const defaultLifetime = 3600 * time.Second
 
-func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, error) {
+func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, io.Closer, error) {
 	// - prefix: 2001:db8::/48 64
 	if len(args) < 2 {
-		return nil, errors.New("Need both a subnet and an allocation max size")
+		return nil, nil, errors.New("Need both a subnet and an allocation max size")
+	}
+	opts, err := plugins.ParseOptions(args[2:])
+	if err != nil {
+		return nil, nil, err
 	}
 
 	_, prefix, err := net.ParseCIDR(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("Invalid pool subnet: %v", err)
+		return nil, nil, fmt.Errorf("Invalid pool subnet: %v", err)
 	}
 
 	allocSize, err := strconv.Atoi(args[1])
 	if err != nil || allocSize > 128 || allocSize < 0 {
-		return nil, fmt.Errorf("Invalid prefix length: %v", err)
+		return nil, nil, fmt.Errorf("Invalid prefix length: %v", err)
+	}
+
+	preferred, err := opts.Duration("preferred", defaultLifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid, err := opts.Duration("valid", preferred)
+	if err != nil {
+		return nil, nil, err
+	}
+	if preferred == 0 || valid < preferred {
+		return nil, nil, fmt.Errorf("Invalid lifetimes: preferred %s must be non-zero and at most valid %s", preferred, valid)
+	}
+	grace, err := opts.Duration("grace", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	sweepInterval, err := opts.Duration("sweep", leasestore.DefaultSweepInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sweepInterval == 0 {
+		return nil, nil, errors.New("sweep interval cannot be zero")
+	}
+	compactInterval, err := opts.Duration("compact", leasestore.DefaultCompactInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	leasefile := opts.String("leasefile", "")
+	backend := opts.String("backend", leasestore.BackendFile)
+	if err := opts.Check(); err != nil {
+		return nil, nil, err
 	}
 
 	plog := logger.CreatePluginLogger(serverLogger, pluginName, true)
 	// TODO: select allocators based on heuristics or user configuration
 	alloc, err := bitmap.NewBitmapAllocator(plog, *prefix, allocSize)
 	if err != nil {
-		return nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
+		return nil, nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
+	}
+
+	p := &pluginState{
+		Records:           make(map[string][]lease),
+		PreferredLifetime: preferred,
+		ValidLifetime:     valid,
+		GracePeriod:       grace,
+		allocator:         alloc,
+		log:               plog,
+	}
+	if leasefile != "" {
+		p.store, err = leasestore.Open(backend, leasefile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not setup lease storage: %w", err)
+		}
+		if err := p.loadRecords(time.Now()); err != nil {
+			p.store.Close()
+			return nil, nil, err
+		}
+		p.log.Printf("Loaded %d delegated prefixes from %s", p.count(), leasefile)
 	}
 
-	return (&pluginState{
-		Records:   make(map[string][]lease),
-		allocator: alloc,
-		log:       plog,
-	}).handle6, nil
+	p.maintainer = leasestore.Maintain(p.log, p.store, &p.Mutex, p.sweep, sweepInterval, compactInterval)
+
+	return p.handle6, p, nil
 }
 
 type lease struct {
@@ -87,9 +153,19 @@ type pluginState struct {
 	sync.Mutex
 	// Records has a string'd []byte as key, because []byte can't be a key itself
 	// Since it's not valid utf-8 we can't use any other string function though
-	Records   map[string][]lease
-	allocator allocators.Allocator
-	log       logrus.FieldLogger
+	Records map[string][]lease
+	// PreferredLifetime and ValidLifetime are given to delegated prefixes. A
+	// lease expires once its valid lifetime is over
+	PreferredLifetime time.Duration
+	ValidLifetime     time.Duration
+	// GracePeriod is how long an expired prefix is kept for its client before
+	// it is returned to the pool
+	GracePeriod time.Duration
+	// store persists the leases, it is nil when they're only kept in memory
+	store      leasestore.LeaseStore
+	allocator  allocators.Allocator
+	log        logrus.FieldLogger
+	maintainer *leasestore.Maintainer
 }
 
 // samePrefix returns true if both prefixes are defined and equal
@@ -120,6 +196,10 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		return nil, true
 	}
 
+	if msg.MessageType == dhcpv6.MessageTypeRelease {
+		return p.release(client, msg, resp), false
+	}
+
 	// Each request IA_PD requires an IA_PD response
 	for _, iapd := range msg.Options.IAPD() {
 		if err != nil {
@@ -147,6 +227,11 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// A possible simple optimization here would be to be able to lock single map values
 		// individually instead of the whole map, since we lock for some amount of time
 		p.Lock()
+		if p.maintainer.HandedOver() {
+			// The leases belong to the instance replacing this one on reload
+			p.Unlock()
+			return nil, true
+		}
 		knownLeases := p.Records[recordKey(client)]
 		// Bitmap to track which leases are already given in this exchange
 		givenOut := bitset.New(uint(len(knownLeases)))
@@ -160,13 +245,10 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		for hintIdx, h := range hints {
 			for leaseIdx := range knownLeases {
 				if samePrefix(h.Prefix, &knownLeases[leaseIdx].Prefix) {
-					expire := time.Now().Add(leaseDuration)
-					if knownLeases[leaseIdx].Expire.Before(expire) {
-						knownLeases[leaseIdx].Expire = expire
-					}
+					p.extend(client, &knownLeases[leaseIdx])
 					satisfied.Set(uint(hintIdx))
 					givenOut.Set(uint(leaseIdx))
-					addPrefix(iapdResp, knownLeases[leaseIdx])
+					p.addPrefix(iapdResp, knownLeases[leaseIdx])
 				}
 			}
 		}
@@ -175,7 +257,7 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// have already assigned to this client
 		for hintIdx, h := range hints {
 			if satisfied.Test(uint(hintIdx)) ||
-				(h.Prefix != nil && !h.Prefix.IP.Equal(net.IPv6zero)) {
+				(h.Prefix != nil && h.Prefix.IP != nil && !h.Prefix.IP.Equal(net.IPv6zero)) {
 				continue
 			}
 			for leaseIdx, l := range knownLeases {
@@ -191,13 +273,10 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 						continue
 					}
 				}
-				expire := time.Now().Add(leaseDuration)
-				if knownLeases[leaseIdx].Expire.Before(expire) {
-					knownLeases[leaseIdx].Expire = expire
-				}
+				p.extend(client, &knownLeases[leaseIdx])
 				satisfied.Set(uint(hintIdx))
 				givenOut.Set(uint(leaseIdx))
-				addPrefix(iapdResp, knownLeases[leaseIdx])
+				p.addPrefix(iapdResp, knownLeases[leaseIdx])
 			}
 		}
 
@@ -210,7 +289,7 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		// with an empty, or length-only hint)
 
 		// Assign a new lease to satisfy the request
-		var newLeases []lease
+		newLeases := knownLeases
 		for i, prefix := range hints {
 			if satisfied.Test(uint(i)) {
 				continue
@@ -227,16 +306,17 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 				continue
 			}
 			l := lease{
-				Expire: time.Now().Add(leaseDuration),
+				Expire: time.Now().Add(p.ValidLifetime).Round(time.Second),
 				Prefix: allocated,
 			}
+			p.save(client, l)
 
-			addPrefix(iapdResp, l)
-			newLeases = append(knownLeases, l)
+			p.addPrefix(iapdResp, l)
+			newLeases = append(newLeases, l)
 			p.log.Debugf("Allocated %s to %s (IAID: %x)", &allocated, client, iapd.IaId)
 		}
 
-		if newLeases != nil {
+		if len(newLeases) > 0 {
 			p.Records[recordKey(client)] = newLeases
 		}
 		p.Unlock()
@@ -254,16 +334,197 @@ func (p *pluginState) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	return resp, false
 }
 
-func addPrefix(resp *dhcpv6.OptIAPD, l lease) {
-	lifetime := time.Until(l.Expire)
+func (p *pluginState) addPrefix(resp *dhcpv6.OptIAPD, l lease) {
+	valid := time.Until(l.Expire).Truncate(time.Second)
+	if valid < 0 {
+		valid = 0
+	}
+	// The preferred lifetime ends the same amount of time before the valid one
+	// as in a freshly extended lease
+	preferred := valid - (p.ValidLifetime - p.PreferredLifetime)
+	if preferred < 0 {
+		preferred = 0
+	}
 
 	resp.Options.Add(&dhcpv6.OptIAPrefix{
-		PreferredLifetime: lifetime,
-		ValidLifetime:     lifetime,
+		PreferredLifetime: preferred,
+		ValidLifetime:     valid,
 		Prefix:            dup(&l.Prefix),
 	})
 }
 
+// extend makes sure the lease outlasts the lifetimes about to be given out. It
+// must be called with the lock held
+func (p *pluginState) extend(client *dhcpv6.Duid, l *lease) {
+	expire := time.Now().Add(p.ValidLifetime).Round(time.Second)
+	if l.Expire.Before(expire) {
+		l.Expire = expire
+		p.save(client, *l)
+	}
+}
+
+// release handles a Release message, returning the released prefixes to the
+// pool. It must be called without the lock held
+func (p *pluginState) release(client *dhcpv6.Duid, msg *dhcpv6.Message, resp dhcpv6.DHCPv6) dhcpv6.DHCPv6 {
+	p.Lock()
+	defer p.Unlock()
+	if p.maintainer.HandedOver() {
+		return nil
+	}
+	key := recordKey(client)
+	for _, iapd := range msg.Options.IAPD() {
+		released := false
+		for _, h := range iapd.Options.Prefixes() {
+			leases := p.Records[key]
+			for i, l := range leases {
+				if !samePrefix(h.Prefix, &l.Prefix) {
+					continue
+				}
+				p.free(client, l)
+				p.Records[key] = append(leases[:i], leases[i+1:]...)
+				p.log.Debugf("Released %s from %s (IAID: %x)", &l.Prefix, client, iapd.IaId)
+				released = true
+				break
+			}
+		}
+		if len(p.Records[key]) == 0 {
+			delete(p.Records, key)
+		}
+		status := dhcpIana.StatusSuccess
+		if !released {
+			// RFC8415 §18.3.7
+			status = dhcpIana.StatusNoBinding
+		}
+		resp.AddOption(&dhcpv6.OptIAPD{
+			IaId:    iapd.IaId,
+			Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{&dhcpv6.OptStatusCode{StatusCode: status}}},
+		})
+	}
+	if resp.GetOneOption(dhcpv6.OptionStatusCode) == nil {
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: dhcpIana.StatusSuccess})
+	}
+	return resp
+}
+
+// save persists a lease, if leases are persisted
+func (p *pluginState) save(client *dhcpv6.Duid, l lease) {
+	if p.store == nil {
+		return
+	}
+	err := p.store.Upsert(&leasestore.Lease{
+		Owner:   hex.EncodeToString(client.ToBytes()),
+		Addr:    l.Prefix,
+		Expires: l.Expire,
+	})
+	if err != nil {
+		p.log.Errorf("Could not persist lease %s for %s: %v", &l.Prefix, client, err)
+	}
+}
+
+// free returns the prefix of a lease to the pool and forgets the lease. The
+// caller is responsible for removing it from Records
+func (p *pluginState) free(owner fmt.Stringer, l lease) {
+	if err := p.allocator.Free(l.Prefix); err != nil {
+		p.log.Errorf("Could not free prefix %s of %s: %v", &l.Prefix, owner, err)
+	}
+	if p.store != nil {
+		if err := p.store.Delete(l.Prefix); err != nil {
+			p.log.Errorf("Could not delete lease %s of %s: %v", &l.Prefix, owner, err)
+		}
+	}
+}
+
+// count returns the number of delegated prefixes
+func (p *pluginState) count() int {
+	n := 0
+	for _, leases := range p.Records {
+		n += len(leases)
+	}
+	return n
+}
+
+// sweep returns the prefixes of all leases that expired before now, minus the
+// grace period, to the pool. It returns how many were reclaimed
+func (p *pluginState) sweep(now time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	reclaimed := 0
+	for key, leases := range p.Records {
+		kept := leases[:0]
+		for _, l := range leases {
+			if l.Expire.Add(p.GracePeriod).Before(now) {
+				p.free(hexKey(key), l)
+				reclaimed++
+			} else {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.Records, key)
+		} else {
+			p.Records[key] = kept
+		}
+	}
+	return reclaimed
+}
+
+// Handover hands the lease storage over to the instance replacing this one
+// on reload, see plugins.Handover
+func (p *pluginState) Handover() func(retired bool) {
+	return p.maintainer.Handover()
+}
+
+// Close stops the maintenance of the leases and closes the lease storage, if any
+func (p *pluginState) Close() error {
+	return p.maintainer.Close()
+}
+
+// hexKey formats a Records key for logging
+type hexKey string
+
+func (k hexKey) String() string {
+	return hex.EncodeToString([]byte(k))
+}
+
+// loadRecords loads the leases held in the lease store, reserves their
+// prefixes in the allocator, and drops the ones that are long expired
+func (p *pluginState) loadRecords(now time.Time) error {
+	var expired []net.IPNet
+	err := p.store.Iterate(func(sl *leasestore.Lease) error {
+		owner, err := hex.DecodeString(sl.Owner)
+		if err != nil {
+			return fmt.Errorf("malformed client ID: %s", sl.Owner)
+		}
+		l := lease{Prefix: sl.Addr, Expire: sl.Expires}
+		if l.Expire.Add(p.GracePeriod).Before(now) {
+			expired = append(expired, sl.Addr)
+			return nil
+		}
+		allocated, err := p.allocator.Allocate(sl.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to re-allocate delegated prefix %s: %v", &sl.Addr, err)
+		}
+		if !samePrefix(&allocated, &sl.Addr) {
+			// Most likely the configuration changed, don't keep the wrong prefix
+			if err := p.allocator.Free(allocated); err != nil {
+				p.log.Errorf("BUG: could not free %s: %v", &allocated, err)
+			}
+			return fmt.Errorf("allocator did not re-allocate delegated prefix %s: %s", &sl.Addr, &allocated)
+		}
+		p.Records[string(owner)] = append(p.Records[string(owner)], l)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not load records: %w", err)
+	}
+	for _, addr := range expired {
+		if err := p.store.Delete(addr); err != nil {
+			return fmt.Errorf("could not delete expired lease %s: %w", &addr, err)
+		}
+	}
+	return nil
+}
+
 func dup(src *net.IPNet) (dst *net.IPNet) {
 	dst = &net.IPNet{
 		IP:   make(net.IP, net.IPv6len),
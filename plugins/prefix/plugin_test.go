@@ -5,10 +5,16 @@
 package prefix
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/insei/coredhcp/handler"
 	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins/allocators/bitmap"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	dhcpIana "github.com/insomniacslk/dhcp/iana"
 )
@@ -38,10 +44,11 @@ func TestRoundTrip(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	handler, err := setup6(testsLogger, "2001:db8::/48", "64")
+	handler, closer, err := setup6(testsLogger, "2001:db8::/48", "64")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer closer.Close()
 
 	result, final := handler(req, resp)
 	if final {
@@ -94,3 +101,123 @@ func TestDup(t *testing.T) {
 		t.Fatalf("dup doesn't work: got %v expected %v", dupPrefix, prefix)
 	}
 }
+
+// exchangePD sends a message of the given type with a single IA_PD, hinting
+// the given prefix if non-nil, and returns the IA_PD of the response
+func exchangePD(t *testing.T, h handler.Handler6, mt dhcpv6.MessageType, hint *net.IPNet) *dhcpv6.OptIAPD {
+	req, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        dhcpIana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}))
+	iapd := &dhcpv6.OptIAPD{IaId: [4]uint8{0x12, 0x34, 0x56, 0x78}}
+	if hint != nil {
+		iapd.Options.Add(&dhcpv6.OptIAPrefix{Prefix: hint})
+	}
+	req.AddOption(iapd)
+
+	resp, err := dhcpv6.NewMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.MessageType = dhcpv6.MessageTypeReply
+	resp.TransactionID = req.TransactionID
+	result, _ := h(req, resp)
+	iapds := result.(*dhcpv6.Message).Options.IAPD()
+	if len(iapds) != 1 {
+		t.Fatalf("Malformed response, expected exactly 1 IAPD, got %d", len(iapds))
+	}
+	return iapds[0]
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp_prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"2001:db8::/48", "64", "leasefile=" + filepath.Join(dir, "leases.txt"),
+		"preferred=30m", "valid=1h"}
+
+	h, closer, err := setup6(testsLogger, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := exchangePD(t, h, dhcpv6.MessageTypeRequest, nil).Options.Prefixes()
+	if len(prefixes) != 1 {
+		t.Fatalf("Expected exactly one prefix, got %s", prefixes)
+	}
+	first := prefixes[0]
+	if first.ValidLifetime > time.Hour || first.ValidLifetime < time.Hour-time.Minute {
+		t.Fatalf("Unexpected valid lifetime %s", first.ValidLifetime)
+	}
+	if first.PreferredLifetime > 30*time.Minute || first.PreferredLifetime < 29*time.Minute {
+		t.Fatalf("Unexpected preferred lifetime %s", first.PreferredLifetime)
+	}
+
+	// A restarted server gives the same prefix back
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, closer, err = setup6(testsLogger, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	prefixes = exchangePD(t, h, dhcpv6.MessageTypeRenew, nil).Options.Prefixes()
+	if len(prefixes) != 1 || !samePrefix(prefixes[0].Prefix, first.Prefix) {
+		t.Fatalf("Expected %s after restart, got %s", first.Prefix, prefixes)
+	}
+
+	// Once released, the delegation is gone for good
+	iapd := exchangePD(t, h, dhcpv6.MessageTypeRelease, first.Prefix)
+	if status := iapd.Options.Status(); status == nil || status.StatusCode != dhcpIana.StatusSuccess {
+		t.Fatalf("Expected a success status, got %v", status)
+	}
+	iapd = exchangePD(t, h, dhcpv6.MessageTypeRelease, first.Prefix)
+	if status := iapd.Options.Status(); status == nil || status.StatusCode != dhcpIana.StatusNoBinding {
+		t.Fatalf("Expected a NoBinding status, got %v", status)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	_, pool, err := net.ParseCIDR("2001:db8::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := bitmap.NewBitmapAllocator(testsLogger, *pool, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pluginState{
+		Records:           make(map[string][]lease),
+		PreferredLifetime: time.Hour,
+		ValidLifetime:     time.Hour,
+		GracePeriod:       time.Minute,
+		allocator:         alloc,
+		log:               testsLogger,
+	}
+	now := time.Now()
+	for i, expire := range []time.Time{now.Add(-2 * time.Minute), now.Add(-30 * time.Second), now.Add(time.Hour)} {
+		allocated, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Records[string([]byte{byte(i)})] = []lease{{Prefix: allocated, Expire: expire}}
+	}
+
+	if n := p.sweep(now); n != 1 {
+		t.Fatalf("Expected 1 reclaimed prefix, got %d", n)
+	}
+	if n := p.count(); n != 2 {
+		t.Fatalf("Expected 2 remaining prefixes, got %d", n)
+	}
+	if _, ok := p.Records[string([]byte{0})]; ok {
+		t.Fatal("Expired prefix past its grace period was kept")
+	}
+}
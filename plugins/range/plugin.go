@@ -8,8 +8,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
 	"sync"
 	"time"
 
@@ -18,19 +18,26 @@ import (
 	"github.com/insei/coredhcp/plugins"
 	"github.com/insei/coredhcp/plugins/allocators"
 	"github.com/insei/coredhcp/plugins/allocators/bitmap"
+	"github.com/insei/coredhcp/plugins/leasestore"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/sirupsen/logrus"
 )
 
 const pluginName = "range"
 
+const (
+	// defaultQuarantine is how long declined addresses are withheld when
+	// the `quarantine` argument isn't given
+	defaultQuarantine = 24 * time.Hour
+)
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   pluginName,
-	Setup4: setup4,
+	Name:  pluginName,
+	Init4: setup4,
 }
 
-//Record holds an IP lease record
+// Record holds an IP lease record
 type Record struct {
 	IP      net.IP
 	expires time.Time
@@ -38,20 +45,43 @@ type Record struct {
 
 // pluginState is the data held by an instance of the range plugin
 type pluginState struct {
-	// Rough lock for the whole plugin, we'll get better performance once we use leasestorage
+	// Rough lock for the whole plugin
 	sync.Mutex
 	// Recordsv4 holds a MAC -> IP address and lease time mapping
 	Recordsv4 map[string]*Record
+	// declined maps addresses declined by clients to the end of their quarantine
+	declined  map[string]time.Time
 	LeaseTime time.Duration
-	leasefile *os.File
-	allocator allocators.Allocator
-	log       logrus.FieldLogger
+	// GracePeriod is how long an expired lease is kept for its client before
+	// the address is returned to the pool
+	GracePeriod time.Duration
+	// Quarantine is how long a declined address is withheld
+	Quarantine time.Duration
+	store      leasestore.LeaseStore
+	allocator  allocators.Allocator
+	log        logrus.FieldLogger
+	maintainer *leasestore.Maintainer
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *pluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	p.Lock()
 	defer p.Unlock()
+	if p.maintainer.HandedOver() {
+		// The leases belong to the instance replacing this one on reload
+		return nil, true
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease:
+		p.release(req)
+		return resp, false
+	case dhcpv4.MessageTypeDecline:
+		p.decline(req)
+		return resp, false
+	case dhcpv4.MessageTypeInform:
+		// The client configured its address by other means
+		return resp, false
+	}
 	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
 	if !ok {
 		// Allocating new address since there isn't one allocated
@@ -65,7 +95,7 @@ func (p *pluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 			IP:      ip.IP.To4(),
 			expires: time.Now().Add(p.LeaseTime),
 		}
-		err = saveIPAddress(p.leasefile, req.ClientHWAddr, &rec)
+		err = saveIPAddress(p.store, req.ClientHWAddr, &rec)
 		if err != nil {
 			p.log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
 		}
@@ -75,7 +105,7 @@ func (p *pluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 		// Ensure we extend the existing lease at least past when the one we're giving expires
 		if record.expires.Before(time.Now().Add(p.LeaseTime)) {
 			record.expires = time.Now().Add(p.LeaseTime).Round(time.Second)
-			err := saveIPAddress(p.leasefile, req.ClientHWAddr, record)
+			err := saveIPAddress(p.store, req.ClientHWAddr, record)
 			if err != nil {
 				p.log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
 			}
@@ -87,59 +117,202 @@ func (p *pluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 	return resp, false
 }
 
-func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, error) {
+// release returns the address released by a client to the pool. It must be
+// called with the lock held
+func (p *pluginState) release(req *dhcpv4.DHCPv4) {
+	mac := req.ClientHWAddr.String()
+	record, ok := p.Recordsv4[mac]
+	if !ok || !record.IP.Equal(req.ClientIPAddr) {
+		p.log.Warningf("MAC address %s released %s, which it doesn't hold", mac, req.ClientIPAddr)
+		return
+	}
+	p.free(mac, record.IP)
+	delete(p.Recordsv4, mac)
+	p.log.Printf("MAC address %s released %s", mac, record.IP)
+}
+
+// decline takes away from a client the address it declined, and withholds it
+// for the quarantine period. It must be called with the lock held
+func (p *pluginState) decline(req *dhcpv4.DHCPv4) {
+	mac := req.ClientHWAddr.String()
+	record, ok := p.Recordsv4[mac]
+	if !ok || !record.IP.Equal(req.RequestedIPAddress()) {
+		p.log.Warningf("MAC address %s declined %s, which it doesn't hold", mac, req.RequestedIPAddress())
+		return
+	}
+	delete(p.Recordsv4, mac)
+	until := time.Now().Add(p.Quarantine).Round(time.Second)
+	p.declined[record.IP.String()] = until
+	if err := saveDeclined(p.store, record.IP, until); err != nil {
+		p.log.Errorf("Could not persist declined address %s: %v", record.IP, err)
+	}
+	p.log.Warningf("Address %s was declined by MAC address %s, withholding it until %s", record.IP, mac, until)
+}
+
+// free returns an address to the pool. It must be called with the lock held
+func (p *pluginState) free(owner string, ip net.IP) {
+	if err := p.allocator.Free(leasestore.HostNet(ip)); err != nil {
+		p.log.Errorf("Could not free lease %s for %s: %v", ip, owner, err)
+	}
+	if err := p.store.Delete(leasestore.HostNet(ip)); err != nil {
+		p.log.Errorf("Could not delete lease %s for %s: %v", ip, owner, err)
+	}
+}
+
+// reclaimable returns true if the lease has expired for longer than the grace period
+func (p *pluginState) reclaimable(rec *Record, now time.Time) bool {
+	return rec.expires.Add(p.GracePeriod).Before(now)
+}
+
+// sweep frees the addresses of all leases that expired before now, minus the
+// grace period, and of declined addresses at the end of their quarantine. It
+// returns how many addresses were reclaimed
+func (p *pluginState) sweep(now time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	reclaimed := 0
+	for mac, rec := range p.Recordsv4 {
+		if !p.reclaimable(rec, now) {
+			continue
+		}
+		p.free(mac, rec.IP)
+		delete(p.Recordsv4, mac)
+		reclaimed++
+	}
+	for addr, until := range p.declined {
+		if until.Before(now) {
+			p.free(declinedOwner, net.ParseIP(addr).To4())
+			delete(p.declined, addr)
+			reclaimed++
+		}
+	}
+	return reclaimed
+}
+
+// Handover hands the lease storage over to the instance replacing this one
+// on reload, see plugins.Handover
+func (p *pluginState) Handover() func(retired bool) {
+	return p.maintainer.Handover()
+}
+
+// Close stops the maintenance of the leases and closes the lease storage
+func (p *pluginState) Close() error {
+	return p.maintainer.Close()
+}
+
+func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
 	var err error
-	pState := pluginState{log: logger.CreatePluginLogger(serverLogger, pluginName, false)}
+	pState := &pluginState{
+		log: logger.CreatePluginLogger(serverLogger, pluginName, false),
+	}
 
 	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+		return nil, nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+	}
+	opts, err := plugins.ParseOptions(args[4:])
+	if err != nil {
+		return nil, nil, err
 	}
 	filename := args[0]
 	if filename == "" {
-		return nil, errors.New("file name cannot be empty")
+		return nil, nil, errors.New("file name cannot be empty")
 	}
 	ipRangeStart := net.ParseIP(args[1])
 	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
+		return nil, nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
 	}
 	ipRangeEnd := net.ParseIP(args[2])
 	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
+		return nil, nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
 	}
 	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+		return nil, nil, errors.New("start of IP range has to be lower than the end of an IP range")
 	}
 
 	pState.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
 	if err != nil {
-		return nil, fmt.Errorf("could not create an allocator: %w", err)
+		return nil, nil, fmt.Errorf("could not create an allocator: %w", err)
 	}
 
 	pState.LeaseTime, err = time.ParseDuration(args[3])
 	if err != nil {
-		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
+		return nil, nil, fmt.Errorf("invalid lease duration: %v", args[3])
+	}
+
+	pState.GracePeriod, err = opts.Duration("grace", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	sweepInterval, err := opts.Duration("sweep", leasestore.DefaultSweepInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sweepInterval == 0 {
+		return nil, nil, errors.New("sweep interval cannot be zero")
+	}
+	compactInterval, err := opts.Duration("compact", leasestore.DefaultCompactInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	pState.Quarantine, err = opts.Duration("quarantine", defaultQuarantine)
+	if err != nil {
+		return nil, nil, err
+	}
+	backend := opts.String("backend", leasestore.BackendFile)
+	if err := opts.Check(); err != nil {
+		return nil, nil, err
 	}
 
-	pState.Recordsv4, err = loadRecordsFromFile(filename)
+	pState.store, err = leasestore.Open(backend, filename)
 	if err != nil {
-		return nil, fmt.Errorf("could not load records from file: %v", err)
+		return nil, nil, fmt.Errorf("could not setup lease storage: %w", err)
+	}
+	pState.Recordsv4, pState.declined, err = loadRecords(pState.store)
+	if err != nil {
+		pState.store.Close()
+		return nil, nil, fmt.Errorf("could not load records from file: %v", err)
 	}
 
 	pState.log.Printf("Loaded %d DHCPv4 leases from %s", len(pState.Recordsv4), filename)
 
-	for _, v := range pState.Recordsv4 {
+	now := time.Now()
+	for mac, v := range pState.Recordsv4 {
+		if pState.reclaimable(v, now) {
+			// Don't hold on to addresses whose lease is long gone
+			delete(pState.Recordsv4, mac)
+			if err := pState.store.Delete(leasestore.HostNet(v.IP)); err != nil {
+				pState.store.Close()
+				return nil, nil, fmt.Errorf("could not delete expired lease %v: %w", v.IP, err)
+			}
+			continue
+		}
 		ip, err := pState.allocator.Allocate(net.IPNet{IP: v.IP})
 		if err != nil {
-			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
+			pState.store.Close()
+			return nil, nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
 		}
 		if ip.IP.String() != v.IP.String() {
-			return nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
+			pState.store.Close()
+			return nil, nil, fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", v.IP.String(), ip.String())
 		}
 	}
-
-	if err := registerBackingFile(&pState.leasefile, filename); err != nil {
-		return nil, fmt.Errorf("could not setup lease storage: %w", err)
+	for addr, until := range pState.declined {
+		ip := net.ParseIP(addr).To4()
+		if until.Before(now) {
+			delete(pState.declined, addr)
+			if err := pState.store.Delete(leasestore.HostNet(ip)); err != nil {
+				pState.store.Close()
+				return nil, nil, fmt.Errorf("could not delete expired quarantine of %v: %w", ip, err)
+			}
+			continue
+		}
+		if _, err := pState.allocator.Allocate(leasestore.HostNet(ip)); err != nil {
+			pState.store.Close()
+			return nil, nil, fmt.Errorf("failed to re-allocate declined ip %v: %v", ip, err)
+		}
 	}
 
-	return pState.Handler4, nil
+	pState.maintainer = leasestore.Maintain(pState.log, pState.store, &pState.Mutex, pState.sweep, sweepInterval, compactInterval)
+
+	return pState.Handler4, pState, nil
 }
@@ -0,0 +1,167 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insei/coredhcp/plugins/allocators/bitmap"
+	"github.com/insei/coredhcp/plugins/leasestore"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testsLogger = logger.GetLogger("tests")
+
+func TestSweep(t *testing.T) {
+	alloc, err := bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 0), net.IPv4(10, 0, 0, 255))
+	require.NoError(t, err)
+
+	store, _ := tempStore(t, "")
+	now := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+	p := pluginState{
+		Recordsv4: map[string]*Record{
+			"02:00:00:00:00:00": {IP: net.IPv4(10, 0, 0, 0).To4(), expires: now.Add(-time.Hour)},
+			"02:00:00:00:00:01": {IP: net.IPv4(10, 0, 0, 1).To4(), expires: now.Add(-time.Minute)},
+			"02:00:00:00:00:02": {IP: net.IPv4(10, 0, 0, 2).To4(), expires: now.Add(time.Hour)},
+		},
+		GracePeriod: 10 * time.Minute,
+		store:       store,
+		allocator:   alloc,
+		log:         testsLogger,
+	}
+	for mac, rec := range p.Recordsv4 {
+		_, err := alloc.Allocate(net.IPNet{IP: rec.IP})
+		require.NoError(t, err)
+		hwaddr, _ := net.ParseMAC(mac)
+		require.NoError(t, saveIPAddress(store, hwaddr, rec))
+	}
+
+	assert.Equal(t, 1, p.sweep(now), "Only the lease expired past the grace period should be reclaimed")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:00")
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:01", "Lease within the grace period was reclaimed")
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:02", "Active lease was reclaimed")
+	_, err = store.Load(leasestore.HostNet(net.IPv4(10, 0, 0, 0)))
+	assert.Equal(t, leasestore.ErrNotFound, err, "Reclaimed lease is still stored")
+
+	// The reclaimed address is available again
+	ip, err := alloc.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 0)})
+	require.NoError(t, err)
+	assert.True(t, ip.IP.Equal(net.IPv4(10, 0, 0, 0)), "Reclaimed address was not returned to the pool")
+
+	assert.Equal(t, 0, p.sweep(now), "Sweeping twice should be a no-op")
+}
+
+// exchange runs a message of the given type from a client through the
+// handler and returns the response
+func exchange(t *testing.T, h handler.Handler4, mt dhcpv4.MessageType, mac net.HardwareAddr, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	modifiers = append(modifiers, dhcpv4.WithMessageType(mt))
+	req, err := dhcpv4.New(dhcpv4.WithHwAddr(mac))
+	require.NoError(t, err)
+	for _, m := range modifiers {
+		m(req)
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	return resp
+}
+
+func TestReleaseDecline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	args := []string{filepath.Join(dir, "leases.txt"), "10.0.0.1", "10.0.0.3", "1h", "quarantine=1h"}
+	client := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+
+	h, closer, err := setup4(testsLogger, args...)
+	require.NoError(t, err)
+	ip := exchange(t, h, dhcpv4.MessageTypeDiscover, client).YourIPAddr
+	require.NotNil(t, ip)
+
+	// Inform doesn't hand out addresses
+	resp := exchange(t, h, dhcpv4.MessageTypeInform, other, dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 1)))
+	assert.True(t, resp.YourIPAddr.IsUnspecified(), "Address given out in response to Inform")
+
+	// Releasing an address the client doesn't hold is ignored
+	exchange(t, h, dhcpv4.MessageTypeRelease, other, dhcpv4.WithClientIP(ip))
+	assert.True(t, ip.Equal(exchange(t, h, dhcpv4.MessageTypeRequest, client).YourIPAddr))
+
+	// A released address goes back to the pool
+	exchange(t, h, dhcpv4.MessageTypeRelease, client, dhcpv4.WithClientIP(ip))
+	assert.True(t, ip.Equal(exchange(t, h, dhcpv4.MessageTypeDiscover, other).YourIPAddr),
+		"Released address was not returned to the pool")
+
+	// A declined address is withheld from everyone, even across restarts
+	declined := exchange(t, h, dhcpv4.MessageTypeDiscover, client).YourIPAddr
+	exchange(t, h, dhcpv4.MessageTypeDecline, client, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(declined)))
+	require.NoError(t, closer.Close())
+	h, closer, err = setup4(testsLogger, args...)
+	require.NoError(t, err)
+	defer closer.Close()
+	resp = exchange(t, h, dhcpv4.MessageTypeDiscover, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x03})
+	assert.False(t, declined.Equal(resp.YourIPAddr), "Declined address %s was given out", declined)
+}
+
+// TestReloadArgs changes the arguments of the plugin on reload but keeps its
+// lease file, which the new instance opens while the old one still uses it
+func TestReloadArgs(t *testing.T) {
+	for _, backend := range []string{leasestore.BackendFile, leasestore.BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "coredhcptest")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "leases")
+			conf := func(leaseTime string) *config.Config {
+				return &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+					{Name: Plugin.Name, Args: []string{file, "10.0.0.1", "10.0.0.3", leaseTime, "backend=" + backend}},
+				}}}
+			}
+			handle := func(chain *plugins.Chain) handler.Handler4 {
+				return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+					resp, _ = chain.Handlers4[0].Handler(handler.NewContext(context.Background(), testsLogger), req, resp)
+					return resp, false
+				}
+			}
+			client := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+			other := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+			registry := plugins.NewRegistry()
+			require.NoError(t, registry.Register(&Plugin))
+
+			first, err := registry.Load(testsLogger, conf("1h"))
+			require.NoError(t, err)
+			ip := exchange(t, handle(first), dhcpv4.MessageTypeDiscover, client).YourIPAddr
+
+			second, err := registry.Reload(testsLogger, conf("2h"), first)
+			require.NoError(t, err, "New instance could not open the lease file")
+			assert.True(t, ip.Equal(exchange(t, handle(second), dhcpv4.MessageTypeDiscover, client).YourIPAddr))
+			// Closing the old chain leaves the store usable by the new one
+			require.NoError(t, first.Close())
+			otherIP := exchange(t, handle(second), dhcpv4.MessageTypeDiscover, other).YourIPAddr
+			require.NoError(t, second.Close())
+
+			store, err := leasestore.Open(backend, file)
+			require.NoError(t, err)
+			defer store.Close()
+			for _, ip := range []net.IP{ip, otherIP} {
+				_, err := store.Load(leasestore.HostNet(ip))
+				assert.NoError(t, err, "Lease of %s lost", ip)
+			}
+		})
+	}
+}
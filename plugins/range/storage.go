@@ -5,90 +5,72 @@
 package rangeplugin
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
-	"strings"
 	"time"
 
-	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins/leasestore"
 )
 
-var log = logger.GetLogger("plugins/range")
+// declinedOwner is the owner of the stored leases recording declined
+// addresses. It can't collide with a MAC address
+const declinedOwner = "declined"
 
-// loadRecords loads the DHCPv6/v4 Records global map with records stored on
-// the specified file. The records have to be one per line, a mac address and an
-// IP address.
-func loadRecords(r io.Reader) (map[string]*Record, error) {
-	sc := bufio.NewScanner(r)
+// loadRecords loads the DHCPv4 records held in the lease store, as a MAC ->
+// record map, and the declined addresses with the end of their quarantine.
+// Lease files written by older versions may hold several leases for a MAC,
+// in which case only the one expiring last is kept
+func loadRecords(store leasestore.LeaseStore) (map[string]*Record, map[string]time.Time, error) {
 	records := make(map[string]*Record)
-	for sc.Scan() {
-		line := sc.Text()
-		if len(line) == 0 {
-			continue
+	declined := make(map[string]time.Time)
+	var stale []net.IPNet
+	err := store.Iterate(func(lease *leasestore.Lease) error {
+		if ones, bits := lease.Addr.Mask.Size(); lease.Addr.IP.To4() == nil || ones != bits {
+			return fmt.Errorf("expected an IPv4 address, got: %v", lease.Addr.String())
 		}
-		tokens := strings.Fields(line)
-		if len(tokens) != 3 {
-			return nil, fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
+		if lease.Owner == declinedOwner {
+			declined[lease.Addr.IP.String()] = lease.Expires
+			return nil
 		}
-		hwaddr, err := net.ParseMAC(tokens[0])
+		hwaddr, err := net.ParseMAC(lease.Owner)
 		if err != nil {
-			return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+			return fmt.Errorf("malformed hardware address: %s", lease.Owner)
 		}
-		ipaddr := net.ParseIP(tokens[1])
-		if ipaddr.To4() == nil {
-			return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+		rec := &Record{IP: lease.Addr.IP.To4(), expires: lease.Expires}
+		if old, ok := records[hwaddr.String()]; ok {
+			if old.expires.After(rec.expires) {
+				rec, old = old, rec
+			}
+			stale = append(stale, leasestore.HostNet(old.IP))
 		}
-		expires, err := time.Parse(time.RFC3339, tokens[2])
-		if err != nil {
-			return nil, fmt.Errorf("expected time of exipry in RFC3339 format, got: %v", tokens[2])
-		}
-		records[hwaddr.String()] = &Record{IP: ipaddr, expires: expires}
+		records[hwaddr.String()] = rec
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return records, nil
-}
-
-func loadRecordsFromFile(filename string) (map[string]*Record, error) {
-	reader, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0640)
-	defer func() {
-		if err := reader.Close(); err != nil {
-			log.Warningf("Failed to close file %s: %v", filename, err)
+	for _, addr := range stale {
+		if err := store.Delete(addr); err != nil {
+			return nil, nil, err
 		}
-	}()
-	if err != nil {
-		return nil, fmt.Errorf("cannot open lease file %s: %w", filename, err)
 	}
-	return loadRecords(reader)
+	return records, declined, nil
 }
 
 // saveIPAddress writes out a lease to storage
-func saveIPAddress(leaseFile *os.File, mac net.HardwareAddr, record *Record) error {
-	_, err := leaseFile.WriteString(mac.String() + " " + record.IP.String() + " " + record.expires.Format(time.RFC3339) + "\n")
-	if err != nil {
-		return err
-	}
-	err = leaseFile.Sync()
-	if err != nil {
-		return err
-	}
-	return nil
+func saveIPAddress(store leasestore.LeaseStore, mac net.HardwareAddr, record *Record) error {
+	return store.Upsert(&leasestore.Lease{
+		Owner:   mac.String(),
+		Addr:    leasestore.HostNet(record.IP),
+		Expires: record.expires,
+	})
 }
 
-// registerBackingFile installs a file as the backing store for leases
-func registerBackingFile(current **os.File, newFileName string) error {
-	if *current != nil {
-		// This is TODO; swapping the file out is easy
-		// but maintaining consistency with the in-memory state isn't
-		return errors.New("cannot swap out a lease storage file while running")
-	}
-	// We never close this, but that's ok because plugins are never stopped/unregistered
-	newLeasefile, err := os.OpenFile(newFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open lease file %s: %w", newFileName, err)
-	}
-	*current = newLeasefile
-	return nil
+// saveDeclined records a declined address until the end of its quarantine
+func saveDeclined(store leasestore.LeaseStore, ip net.IP, until time.Time) error {
+	return store.Upsert(&leasestore.Lease{
+		Owner:   declinedOwner,
+		Addr:    leasestore.HostNet(ip),
+		Expires: until,
+	})
 }
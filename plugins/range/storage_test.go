@@ -8,11 +8,13 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"strings"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/insei/coredhcp/plugins/leasestore"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var leasefile string = `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
@@ -28,16 +30,32 @@ var records = []struct {
 	mac string
 	ip  *Record
 }{
-	{"02:00:00:00:00:00", &Record{net.IPv4(10, 0, 0, 0), expire}},
-	{"02:00:00:00:00:01", &Record{net.IPv4(10, 0, 0, 1), expire}},
-	{"02:00:00:00:00:02", &Record{net.IPv4(10, 0, 0, 2), expire}},
-	{"02:00:00:00:00:03", &Record{net.IPv4(10, 0, 0, 3), expire}},
-	{"02:00:00:00:00:04", &Record{net.IPv4(10, 0, 0, 4), expire}},
-	{"02:00:00:00:00:05", &Record{net.IPv4(10, 0, 0, 5), expire}},
+	{"02:00:00:00:00:00", &Record{net.IPv4(10, 0, 0, 0).To4(), expire}},
+	{"02:00:00:00:00:01", &Record{net.IPv4(10, 0, 0, 1).To4(), expire}},
+	{"02:00:00:00:00:02", &Record{net.IPv4(10, 0, 0, 2).To4(), expire}},
+	{"02:00:00:00:00:03", &Record{net.IPv4(10, 0, 0, 3).To4(), expire}},
+	{"02:00:00:00:00:04", &Record{net.IPv4(10, 0, 0, 4).To4(), expire}},
+	{"02:00:00:00:00:05", &Record{net.IPv4(10, 0, 0, 5).To4(), expire}},
+}
+
+// tempStore creates a file-backed lease store holding the given contents
+func tempStore(t *testing.T, contents string) (*leasestore.FileStore, string) {
+	dir, err := ioutil.TempDir("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "leases.txt")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0640))
+	store, err := leasestore.NewFileStore(filename)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store, filename
 }
 
 func TestLoadRecords(t *testing.T) {
-	parsedRec, err := loadRecords(strings.NewReader(leasefile))
+	store, _ := tempStore(t, leasefile)
+	parsedRec, _, err := loadRecords(store)
 	if err != nil {
 		t.Fatalf("Failed to load records from file: %v", err)
 	}
@@ -50,19 +68,23 @@ func TestLoadRecords(t *testing.T) {
 	assert.Equal(t, mapRec, parsedRec, "Loaded records differ from what's in the file")
 }
 
-func TestWriteRecords(t *testing.T) {
-	tmpfile, err := os.CreateTemp("", "coredhcptest")
-	if err != nil {
-		t.Skipf("Could not setup file-based test: %v", err)
-	}
-	defer os.Remove(tmpfile.Name())
-	defer tmpfile.Close()
+func TestLoadRecordsDuplicateMAC(t *testing.T) {
+	// Older versions of the plugin could leave several leases for a MAC
+	store, _ := tempStore(t, `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
+02:00:00:00:00:00 10.0.0.1 2000-01-02T00:00:00Z
+`)
+	parsedRec, _, err := loadRecords(store)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*Record{
+		"02:00:00:00:00:00": {net.IPv4(10, 0, 0, 1).To4(), expire.Add(24 * time.Hour)},
+	}, parsedRec)
 
-	var leaseFile *os.File
-	if err := registerBackingFile(&leaseFile, tmpfile.Name()); err != nil {
-		t.Fatalf("Could not setup file")
-	}
-	defer leaseFile.Close()
+	_, err = store.Load(leasestore.HostNet(net.IPv4(10, 0, 0, 0)))
+	assert.Equal(t, leasestore.ErrNotFound, err, "Superseded lease was not deleted")
+}
+
+func TestWriteRecords(t *testing.T) {
+	store, filename := tempStore(t, "")
 
 	for _, rec := range records {
 		hwaddr, err := net.ParseMAC(rec.mac)
@@ -70,16 +92,12 @@ func TestWriteRecords(t *testing.T) {
 			// bug in testdata
 			panic(err)
 		}
-		if err := saveIPAddress(leaseFile, hwaddr, rec.ip); err != nil {
+		if err := saveIPAddress(store, hwaddr, rec.ip); err != nil {
 			t.Errorf("Failed to save ip for %s: %v", hwaddr, err)
 		}
 	}
 
-	if _, err := tmpfile.Seek(0, 0); err != nil {
-		t.Fatal(err)
-	}
-
-	written, err := ioutil.ReadAll(tmpfile)
+	written, err := ioutil.ReadFile(filename)
 	if err != nil {
 		t.Fatalf("Could not read back temp file")
 	}
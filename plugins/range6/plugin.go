@@ -0,0 +1,591 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package range6 implements a plugin allocating IA_NA addresses to DHCPv6
+// clients out of a pool, keyed by DUID and IAID, and persisting the leases.
+//
+// Arguments for the plugin configuration are as follows, in this order:
+// - lease file: where the leases are stored across server restarts
+// - pool: either a start and an end address, or a prefix
+// - lease duration: the valid and preferred lifetimes of the addresses
+// followed by optional key=value arguments:
+// - grace: how long an expired lease is kept for its client (default: 0s)
+// - sweep: how often expired leases are looked for (default: 1m)
+// - compact: how often the lease file is compacted, for the file backend (default: 1h)
+// - backend: the lease storage backend, file or bolt (default: file)
+// - quarantine: how long a declined address is withheld (default: 24h)
+// - link: the on-link prefix the pool belongs to, used to answer Confirm
+// messages (default: the pool prefix, or the /64 holding the range)
+//
+// Example:
+//
+//	server6:
+//	  plugins:
+//	    - range6: leases6.txt 2001:db8::1:0 2001:db8::1:ffff 1h
+//
+// or, for a pool covering a whole prefix, stored in a bolt database:
+//
+//   - range6: leases6.db 2001:db8::/112 1h backend=bolt quarantine=1h
+package range6
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/sirupsen/logrus"
+
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insei/coredhcp/plugins/allocators"
+	"github.com/insei/coredhcp/plugins/allocators/bitmap"
+	"github.com/insei/coredhcp/plugins/leasestore"
+)
+
+const pluginName = "range6"
+
+// linksKey is the context key of the on-link prefixes of the pools the
+// range6 instances handling a Confirm message have gone through
+const linksKey = pluginName + ".links"
+
+const (
+	// defaultQuarantine is how long declined addresses are withheld when
+	// the `quarantine` argument isn't given. This is what Kea does
+	defaultQuarantine = 24 * time.Hour
+)
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:         pluginName,
+	InitContext6: setup6,
+}
+
+// Record holds an IPv6 address lease record
+type Record struct {
+	IP      net.IP
+	expires time.Time
+}
+
+// pluginState is the data held by an instance of the range6 plugin
+type pluginState struct {
+	// Rough lock for the whole plugin
+	sync.Mutex
+	// Records maps a DUID+IAID key to the address leased to that IA
+	Records map[string]*Record
+	// declined maps addresses declined by clients to the end of their quarantine
+	declined    map[string]time.Time
+	LeaseTime   time.Duration
+	GracePeriod time.Duration
+	Quarantine  time.Duration
+	// Link is the on-link prefix of the pool
+	Link       net.IPNet
+	store      leasestore.LeaseStore
+	allocator  allocators.Allocator
+	log        logrus.FieldLogger
+	maintainer *leasestore.Maintainer
+}
+
+// recordKey computes the key of the Records map for an IA of a client
+func recordKey(duid *dhcpv6.Duid, iaid [4]byte) string {
+	return hex.EncodeToString(duid.ToBytes()) + "-" + hex.EncodeToString(iaid[:])
+}
+
+// answer returns the IA_NA answered by an earlier plugin for the given IAID,
+// if any
+func answer(resp *dhcpv6.Message, iaid [4]byte) *dhcpv6.OptIANA {
+	for _, ia := range resp.Options.IANA() {
+		if ia.IaId == iaid {
+			return ia
+		}
+	}
+	return nil
+}
+
+// bound returns true if an IA_NA answer holds an address for the client, or
+// releases or declines one: a pool answering that the IA has no binding or no
+// address leaves it for the next pools to try
+func bound(ia *dhcpv6.OptIANA) bool {
+	if status := ia.Options.Status(); status != nil {
+		return status.StatusCode == dhcpIana.StatusSuccess
+	}
+	for _, addr := range ia.Options.Addresses() {
+		if addr.ValidLifetime > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// replace replaces an option of the response with another
+func replace(resp *dhcpv6.Message, old, new dhcpv6.Option) {
+	for i, opt := range resp.Options.Options {
+		if opt == old {
+			resp.Options.Options[i] = new
+		}
+	}
+}
+
+// addStatus adds a status code to the response unless it already has one
+func addStatus(resp *dhcpv6.Message, code dhcpIana.StatusCode) {
+	if resp.Options.Status() == nil {
+		resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: code})
+	}
+}
+
+// Handler6 handles DHCPv6 packets for the range6 plugin
+func (p *pluginState) Handler6(ctx *handler.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, handler.Result) {
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		p.log.Errorf("BUG: could not decapsulate: %v", err)
+		return nil, handler.Drop(handler.ReasonNoResponse)
+	}
+	respMsg, ok := resp.(*dhcpv6.Message)
+	if !ok {
+		p.log.Errorf("BUG: response is not a DHCPv6 message")
+		return nil, handler.Drop(handler.ReasonNoResponse)
+	}
+	if len(msg.Options.IANA()) == 0 {
+		return resp, handler.Continue
+	}
+	if msg.MessageType == dhcpv6.MessageTypeConfirm {
+		p.confirm(ctx, msg, respMsg)
+		return resp, handler.Continue
+	}
+	client := msg.Options.ClientID()
+	if client == nil {
+		p.log.Error("Invalid packet received, no clientID")
+		return nil, handler.Drop(handler.ReasonNoResponse)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.maintainer.HandedOver() {
+		// The leases belong to the instance replacing this one on reload
+		return nil, handler.Drop(handler.ReasonNoResponse)
+	}
+	for _, ia := range msg.Options.IANA() {
+		prev := answer(respMsg, ia.IaId)
+		if prev != nil && bound(prev) {
+			continue
+		}
+		key := recordKey(client, ia.IaId)
+		var iaResp *dhcpv6.OptIANA
+		switch msg.MessageType {
+		case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest:
+			iaResp = p.assign(key, ia)
+		case dhcpv6.MessageTypeRenew:
+			iaResp = p.renew(key, ia, false)
+		case dhcpv6.MessageTypeRebind:
+			iaResp = p.renew(key, ia, true)
+		case dhcpv6.MessageTypeRelease:
+			iaResp = p.release(key, ia)
+			addStatus(respMsg, dhcpIana.StatusSuccess)
+		case dhcpv6.MessageTypeDecline:
+			iaResp = p.decline(key, ia)
+			addStatus(respMsg, dhcpIana.StatusSuccess)
+		default:
+			return resp, handler.Continue
+		}
+		if prev == nil {
+			respMsg.AddOption(iaResp)
+		} else if bound(iaResp) {
+			// An earlier pool had no binding or no address for the IA
+			replace(respMsg, prev, iaResp)
+		}
+	}
+	return resp, handler.Continue
+}
+
+// confirm answers a Confirm message with NotOnLink if any of the client's
+// addresses is outside of the links of all the pools the request went
+// through, and Success otherwise (RFC8415 §18.3.3). Several pools can serve a
+// link, so each instance adds its link to those gathered in the context by
+// the earlier ones, and the last one answers for all of them
+func (p *pluginState) confirm(ctx *handler.Context, msg, resp *dhcpv6.Message) {
+	var links []net.IPNet
+	if v, ok := ctx.Get(linksKey); ok {
+		links = v.([]net.IPNet)
+	}
+	links = append(links, p.Link)
+	ctx.Set(linksKey, links)
+
+	code := dhcpIana.StatusSuccess
+	for _, ia := range msg.Options.IANA() {
+		for _, addr := range ia.Options.Addresses() {
+			if !onLink(links, addr.IPv6Addr) {
+				p.log.Debugf("Address %s is on none of the links %v", addr.IPv6Addr, links)
+				code = dhcpIana.StatusNotOnLink
+			}
+		}
+	}
+	resp.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: code})
+}
+
+// onLink returns true if one of the links contains addr
+func onLink(links []net.IPNet, addr net.IP) bool {
+	for _, link := range links {
+		if link.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// newIA returns an IA_NA response holding the given address, if any
+func (p *pluginState) newIA(iaid [4]byte, rec *Record) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{IaId: iaid}
+	if rec != nil {
+		ia.T1 = p.LeaseTime / 2
+		ia.T2 = p.LeaseTime * 4 / 5
+		ia.Options.Add(&dhcpv6.OptIAAddress{
+			IPv6Addr:          rec.IP,
+			PreferredLifetime: p.LeaseTime,
+			ValidLifetime:     p.LeaseTime,
+		})
+	}
+	return ia
+}
+
+// withStatus adds a status code to an IA_NA response
+func withStatus(ia *dhcpv6.OptIANA, code dhcpIana.StatusCode) *dhcpv6.OptIANA {
+	ia.Options.Add(&dhcpv6.OptStatusCode{StatusCode: code})
+	return ia
+}
+
+// invalidate adds the addresses requested in the IA, other than the one
+// leased to it, with zero lifetimes to tell the client to stop using them
+func invalidate(iaResp, ia *dhcpv6.OptIANA, rec *Record) *dhcpv6.OptIANA {
+	for _, addr := range ia.Options.Addresses() {
+		if rec != nil && addr.IPv6Addr.Equal(rec.IP) {
+			continue
+		}
+		iaResp.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: addr.IPv6Addr})
+	}
+	return iaResp
+}
+
+// extend makes sure the lease outlasts the lifetimes about to be given out.
+// It must be called with the lock held
+func (p *pluginState) extend(key string, rec *Record) {
+	if rec.expires.Before(time.Now().Add(p.LeaseTime)) {
+		rec.expires = time.Now().Add(p.LeaseTime).Round(time.Second)
+		if err := saveIPAddress(p.store, key, rec); err != nil {
+			p.log.Errorf("Could not persist lease for %s: %v", key, err)
+		}
+	}
+}
+
+// bind allocates an address for the IA, preferring hint. If exact is true
+// only hint can be allocated. It must be called with the lock held
+func (p *pluginState) bind(key string, hint net.IP, exact bool) (*Record, error) {
+	ip, err := p.allocator.Allocate(net.IPNet{IP: hint})
+	if err != nil {
+		return nil, err
+	}
+	if exact && !ip.IP.Equal(hint) {
+		if err := p.allocator.Free(ip); err != nil {
+			p.log.Errorf("BUG: could not free %s: %v", ip.IP, err)
+		}
+		return nil, allocators.ErrNoAddrAvail
+	}
+	rec := &Record{
+		IP:      ip.IP,
+		expires: time.Now().Add(p.LeaseTime).Round(time.Second),
+	}
+	if err := saveIPAddress(p.store, key, rec); err != nil {
+		p.log.Errorf("Could not persist lease for %s: %v", key, err)
+	}
+	p.Records[key] = rec
+	p.log.Debugf("Allocated %s to %s", rec.IP, key)
+	return rec, nil
+}
+
+// hint returns the first address requested in the IA, if any
+func hint(ia *dhcpv6.OptIANA) net.IP {
+	if addr := ia.Options.OneAddress(); addr != nil {
+		return addr.IPv6Addr
+	}
+	return nil
+}
+
+// assign handles an IA in a Solicit or Request message. It must be called
+// with the lock held
+func (p *pluginState) assign(key string, ia *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	rec, ok := p.Records[key]
+	if ok {
+		p.extend(key, rec)
+		return invalidate(p.newIA(ia.IaId, rec), ia, rec)
+	}
+	rec, err := p.bind(key, hint(ia), false)
+	if err != nil {
+		p.log.Errorf("Could not allocate an address for %s: %v", key, err)
+		return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusNoAddrsAvail)
+	}
+	return invalidate(p.newIA(ia.IaId, rec), ia, rec)
+}
+
+// renew handles an IA in a Renew or Rebind message. It must be called with
+// the lock held
+func (p *pluginState) renew(key string, ia *dhcpv6.OptIANA, rebind bool) *dhcpv6.OptIANA {
+	rec, ok := p.Records[key]
+	if ok {
+		p.extend(key, rec)
+		return invalidate(p.newIA(ia.IaId, rec), ia, rec)
+	}
+	if !rebind {
+		// RFC8415 §18.3.4
+		return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusNoBinding)
+	}
+	// RFC8415 §18.3.5: we lost the binding, but the client may keep its
+	// address if nobody else got it in the meantime
+	if h := hint(ia); h != nil {
+		if rec, err := p.bind(key, h, true); err == nil {
+			return invalidate(p.newIA(ia.IaId, rec), ia, rec)
+		}
+	}
+	return invalidate(p.newIA(ia.IaId, nil), ia, nil)
+}
+
+// lookup returns the record of the IA if the IA holds its address. It must
+// be called with the lock held
+func (p *pluginState) lookup(key string, ia *dhcpv6.OptIANA) *Record {
+	rec, ok := p.Records[key]
+	if !ok {
+		return nil
+	}
+	for _, addr := range ia.Options.Addresses() {
+		if addr.IPv6Addr.Equal(rec.IP) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// release handles an IA in a Release message. It must be called with the
+// lock held
+func (p *pluginState) release(key string, ia *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	rec := p.lookup(key, ia)
+	if rec == nil {
+		// RFC8415 §18.3.7
+		return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusNoBinding)
+	}
+	p.free(key, rec)
+	p.log.Debugf("Released %s from %s", rec.IP, key)
+	return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusSuccess)
+}
+
+// decline handles an IA in a Decline message: the address is taken away
+// from the client and withheld for the quarantine period. It must be called
+// with the lock held
+func (p *pluginState) decline(key string, ia *dhcpv6.OptIANA) *dhcpv6.OptIANA {
+	rec := p.lookup(key, ia)
+	if rec == nil {
+		// RFC8415 §18.3.8
+		return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusNoBinding)
+	}
+	delete(p.Records, key)
+	until := time.Now().Add(p.Quarantine).Round(time.Second)
+	p.declined[rec.IP.String()] = until
+	if err := saveDeclined(p.store, rec.IP, until); err != nil {
+		p.log.Errorf("Could not persist declined address %s: %v", rec.IP, err)
+	}
+	p.log.Warningf("Address %s was declined by %s, withholding it until %s", rec.IP, key, until)
+	return withStatus(p.newIA(ia.IaId, nil), dhcpIana.StatusSuccess)
+}
+
+// free returns the address of a record to the pool. It must be called with
+// the lock held
+func (p *pluginState) free(key string, rec *Record) {
+	if err := p.allocator.Free(leasestore.HostNet(rec.IP)); err != nil {
+		p.log.Errorf("Could not free lease %s for %s: %v", rec.IP, key, err)
+	}
+	if err := p.store.Delete(leasestore.HostNet(rec.IP)); err != nil {
+		p.log.Errorf("Could not delete lease %s for %s: %v", rec.IP, key, err)
+	}
+	delete(p.Records, key)
+}
+
+// reclaimable returns true if the lease has expired for longer than the grace period
+func (p *pluginState) reclaimable(rec *Record, now time.Time) bool {
+	return rec.expires.Add(p.GracePeriod).Before(now)
+}
+
+// sweep frees the addresses of all leases that expired before now, minus the
+// grace period, and of declined addresses at the end of their quarantine. It
+// returns how many addresses were reclaimed
+func (p *pluginState) sweep(now time.Time) int {
+	p.Lock()
+	defer p.Unlock()
+	reclaimed := 0
+	for key, rec := range p.Records {
+		if p.reclaimable(rec, now) {
+			p.free(key, rec)
+			reclaimed++
+		}
+	}
+	for addr, until := range p.declined {
+		if until.Before(now) {
+			p.free(declinedOwner, &Record{IP: net.ParseIP(addr)})
+			delete(p.declined, addr)
+			reclaimed++
+		}
+	}
+	return reclaimed
+}
+
+// parsePool parses the pool arguments, either a prefix or a start and end
+// address. It returns the first and last addresses of the pool and the number
+// of arguments consumed. A prefix pool leaves out the all-zero interface ID,
+// the Subnet-Router anycast address of the /64 (RFC 4291 §2.6.1)
+func parsePool(args []string) (net.IP, net.IP, int, error) {
+	if strings.Contains(args[0], "/") {
+		_, prefix, err := net.ParseCIDR(args[0])
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, nil, 0, fmt.Errorf("invalid IPv6 prefix: %v", args[0])
+		}
+		first := make(net.IP, net.IPv6len)
+		last := make(net.IP, net.IPv6len)
+		for i := range prefix.IP {
+			first[i] = prefix.IP[i]
+			last[i] = prefix.IP[i] | ^prefix.Mask[i]
+		}
+		if bytes.Equal(first[8:], make([]byte, 8)) {
+			first[net.IPv6len-1] = 1
+			if bytes.Compare(first, last) > 0 {
+				return nil, nil, 0, fmt.Errorf("prefix %v only holds the Subnet-Router anycast address", args[0])
+			}
+		}
+		return first, last, 1, nil
+	}
+	if len(args) < 2 {
+		return nil, nil, 0, errors.New("missing end of the IPv6 range")
+	}
+	start := net.ParseIP(args[0])
+	if start.To16() == nil || start.To4() != nil {
+		return nil, nil, 0, fmt.Errorf("invalid IPv6 address: %v", args[0])
+	}
+	end := net.ParseIP(args[1])
+	if end.To16() == nil || end.To4() != nil {
+		return nil, nil, 0, fmt.Errorf("invalid IPv6 address: %v", args[1])
+	}
+	return start, end, 2, nil
+}
+
+// parseLink parses the on-link prefix of a pool. When not given, it is the
+// pool itself if it's a prefix, or the /64 holding it for a range
+func parseLink(link string, poolArg string, start, end net.IP) (net.IPNet, error) {
+	if link == "" {
+		link = poolArg
+		if !strings.Contains(link, "/") {
+			link = start.String() + "/64"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(link)
+	if err != nil || prefix.IP.To4() != nil {
+		return net.IPNet{}, fmt.Errorf("invalid IPv6 link prefix: %v", link)
+	}
+	if !prefix.Contains(start) || !prefix.Contains(end) {
+		return net.IPNet{}, fmt.Errorf("pool %s-%s is not within link prefix %s", start, end, prefix)
+	}
+	return *prefix, nil
+}
+
+// Handover hands the lease storage over to the instance replacing this one
+// on reload, see plugins.Handover
+func (p *pluginState) Handover() func(retired bool) {
+	return p.maintainer.Handover()
+}
+
+// Close stops the maintenance of the leases and closes the lease storage
+func (p *pluginState) Close() error {
+	return p.maintainer.Close()
+}
+
+func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.ContextHandler6, io.Closer, error) {
+	var err error
+	pState := &pluginState{
+		declined: make(map[string]time.Time),
+		log:      logger.CreatePluginLogger(serverLogger, pluginName, true),
+	}
+
+	if len(args) < 3 {
+		return nil, nil, fmt.Errorf("invalid number of arguments, want at least 3 (file name, prefix or start and end IP, lease time), got: %d", len(args))
+	}
+	filename := args[0]
+	if filename == "" {
+		return nil, nil, errors.New("file name cannot be empty")
+	}
+	start, end, n, err := parsePool(args[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	pState.allocator, err = bitmap.NewIPv6Allocator(start, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create an allocator: %w", err)
+	}
+	poolArg := args[1]
+	args = args[1+n:]
+	if len(args) < 1 {
+		return nil, nil, errors.New("missing lease duration")
+	}
+	pState.LeaseTime, err = time.ParseDuration(args[0])
+	if err != nil || pState.LeaseTime <= 0 {
+		return nil, nil, fmt.Errorf("invalid lease duration: %v", args[0])
+	}
+
+	opts, err := plugins.ParseOptions(args[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	pState.GracePeriod, err = opts.Duration("grace", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	sweepInterval, err := opts.Duration("sweep", leasestore.DefaultSweepInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sweepInterval == 0 {
+		return nil, nil, errors.New("sweep interval cannot be zero")
+	}
+	compactInterval, err := opts.Duration("compact", leasestore.DefaultCompactInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+	pState.Quarantine, err = opts.Duration("quarantine", defaultQuarantine)
+	if err != nil {
+		return nil, nil, err
+	}
+	pState.Link, err = parseLink(opts.String("link", ""), poolArg, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	backend := opts.String("backend", leasestore.BackendFile)
+	if err := opts.Check(); err != nil {
+		return nil, nil, err
+	}
+
+	pState.store, err = leasestore.Open(backend, filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not setup lease storage: %w", err)
+	}
+	if err := pState.loadRecords(time.Now()); err != nil {
+		pState.store.Close()
+		return nil, nil, err
+	}
+	pState.log.Printf("Loaded %d DHCPv6 leases from %s", len(pState.Records), filename)
+
+	pState.maintainer = leasestore.Maintain(pState.log, pState.store, &pState.Mutex, pState.sweep, sweepInterval, compactInterval)
+
+	return pState.Handler6, pState, nil
+}
@@ -0,0 +1,362 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins/allocators/bitmap"
+	"github.com/insei/coredhcp/plugins/leasestore"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcpIana "github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testsLogger = logger.GetLogger("tests")
+
+var (
+	testDuid = dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        dhcpIana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	}
+	testIAID = [4]byte{0x12, 0x34, 0x56, 0x78}
+)
+
+// exchange runs a message of the given type through the handler and returns
+// the IA_NA of the response, and the response itself
+func exchange(t *testing.T, h handler.ContextHandler6, mt dhcpv6.MessageType, addrs ...net.IP) (*dhcpv6.OptIANA, *dhcpv6.Message) {
+	return exchangeAs(t, h, testDuid, mt, addrs...)
+}
+
+// exchangeAs is like exchange, for the client with the given DUID
+func exchangeAs(t *testing.T, h handler.ContextHandler6, duid dhcpv6.Duid, mt dhcpv6.MessageType, addrs ...net.IP) (*dhcpv6.OptIANA, *dhcpv6.Message) {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = mt
+	req.AddOption(dhcpv6.OptClientID(duid))
+	ia := &dhcpv6.OptIANA{IaId: testIAID}
+	for _, a := range addrs {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: a})
+	}
+	req.AddOption(ia)
+
+	// The library can't build replies to every message type
+	resp, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	resp.MessageType = dhcpv6.MessageTypeReply
+	resp.TransactionID = req.TransactionID
+	result, res := h(handler.NewContext(context.Background(), testsLogger), req, resp)
+	require.Equal(t, handler.Continue, res)
+	msg := result.(*dhcpv6.Message)
+	require.Len(t, msg.Options.IANA(), 1)
+	return msg.Options.IANA()[0], msg
+}
+
+// status returns the status code of an IA_NA, success if it has none
+func status(ia *dhcpv6.OptIANA) dhcpIana.StatusCode {
+	if s := ia.Options.Status(); s != nil {
+		return s.StatusCode
+	}
+	return dhcpIana.StatusSuccess
+}
+
+func tempLeaseFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "leases6.txt")
+}
+
+func TestLeaseLifecycle(t *testing.T) {
+	filename := tempLeaseFile(t)
+	h, closer, err := setup6(testsLogger, filename, "2001:db8::1", "2001:db8::2", "1h")
+	require.NoError(t, err)
+
+	ia, _ := exchange(t, h, dhcpv6.MessageTypeSolicit)
+	require.Equal(t, dhcpIana.StatusSuccess, status(ia))
+	addr := ia.Options.OneAddress()
+	require.NotNil(t, addr)
+	assert.Equal(t, time.Hour, addr.ValidLifetime)
+	assert.Equal(t, 30*time.Minute, ia.T1)
+	leased := addr.IPv6Addr
+
+	// The same IA keeps its address
+	for _, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+		ia, _ = exchange(t, h, mt, leased)
+		if assert.NotNil(t, ia.Options.OneAddress(), "No address in reply to %s", mt) {
+			assert.True(t, leased.Equal(ia.Options.OneAddress().IPv6Addr), "Address changed on %s", mt)
+		}
+	}
+
+	// Leases survive restarts
+	require.NoError(t, closer.Close())
+	h, closer, err = setup6(testsLogger, filename, "2001:db8::1", "2001:db8::2", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRenew, leased)
+	if assert.NotNil(t, ia.Options.OneAddress()) {
+		assert.True(t, leased.Equal(ia.Options.OneAddress().IPv6Addr), "Lease was not persisted")
+	}
+
+	// Release, after which the binding is gone
+	ia, msg := exchange(t, h, dhcpv6.MessageTypeRelease, leased)
+	assert.Equal(t, dhcpIana.StatusSuccess, status(ia))
+	if assert.NotNil(t, msg.Options.Status()) {
+		assert.Equal(t, dhcpIana.StatusSuccess, msg.Options.Status().StatusCode)
+	}
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRenew, leased)
+	assert.Equal(t, dhcpIana.StatusNoBinding, status(ia))
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRelease, leased)
+	assert.Equal(t, dhcpIana.StatusNoBinding, status(ia))
+
+	// Rebind can recover a free address
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRebind, leased)
+	if assert.NotNil(t, ia.Options.OneAddress()) {
+		assert.True(t, leased.Equal(ia.Options.OneAddress().IPv6Addr), "Rebind did not restore the binding")
+		assert.NotZero(t, ia.Options.OneAddress().ValidLifetime)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	_, _, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::/96", "1h")
+	assert.Error(t, err, "Pool too large for the allocator accepted")
+	_, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::/104", "1h")
+	require.NoError(t, err)
+	assert.NoError(t, closer.Close())
+}
+
+// TestPrefixPool checks a prefix pool doesn't hand out the Subnet-Router
+// anycast address
+func TestPrefixPool(t *testing.T) {
+	h, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::/127", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	ia, _ := exchange(t, h, dhcpv6.MessageTypeSolicit, net.ParseIP("2001:db8::"))
+	if assert.NotNil(t, ia.Options.OneAddress()) {
+		assert.True(t, net.ParseIP("2001:db8::1").Equal(ia.Options.OneAddress().IPv6Addr))
+	}
+
+	_, _, err = setup6(testsLogger, tempLeaseFile(t), "2001:db8::/128", "1h")
+	assert.Error(t, err, "Pool of the Subnet-Router anycast address accepted")
+}
+
+// chain runs handlers one after the other on the same request, like the
+// server does
+func chain(handlers ...handler.ContextHandler6) handler.ContextHandler6 {
+	return func(ctx *handler.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, handler.Result) {
+		res := handler.Continue
+		for _, h := range handlers {
+			resp, res = h(ctx, req, resp)
+		}
+		return resp, res
+	}
+}
+
+// TestSeveralPools checks an IA goes to the next pool when the first one is
+// exhausted, and that pool keeps handling it
+func TestSeveralPools(t *testing.T) {
+	first, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::1", "2001:db8::1", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	second, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::2", "2001:db8::2", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	h := chain(first, second)
+
+	// client returns the DUID of another client
+	client := func(id byte) dhcpv6.Duid {
+		return dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: dhcpIana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, id}}
+	}
+
+	// Exhaust the first pool with another client
+	taken, _ := exchangeAs(t, first, client(1), dhcpv6.MessageTypeRequest)
+	require.NotNil(t, taken.Options.OneAddress())
+
+	ia, _ := exchange(t, h, dhcpv6.MessageTypeRequest)
+	require.Equal(t, dhcpIana.StatusSuccess, status(ia))
+	require.NotNil(t, ia.Options.OneAddress())
+	leased := ia.Options.OneAddress().IPv6Addr
+	assert.True(t, net.ParseIP("2001:db8::2").Equal(leased))
+
+	for _, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+		ia, _ = exchange(t, h, mt, leased)
+		assert.Equal(t, dhcpIana.StatusSuccess, status(ia), "%s", mt)
+		if assert.NotNil(t, ia.Options.OneAddress(), "%s", mt) {
+			assert.True(t, leased.Equal(ia.Options.OneAddress().IPv6Addr), "Address changed on %s", mt)
+			assert.NotZero(t, ia.Options.OneAddress().ValidLifetime, "%s", mt)
+		}
+	}
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRelease, leased)
+	assert.Equal(t, dhcpIana.StatusSuccess, status(ia))
+
+	// Both pools exhausted
+	exchangeAs(t, second, client(2), dhcpv6.MessageTypeRequest)
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRequest)
+	assert.Equal(t, dhcpIana.StatusNoAddrsAvail, status(ia))
+}
+
+func TestDecline(t *testing.T) {
+	filename := tempLeaseFile(t)
+	h, closer, err := setup6(testsLogger, filename, "2001:db8::/126", "1h")
+	require.NoError(t, err)
+
+	ia, _ := exchange(t, h, dhcpv6.MessageTypeRequest)
+	require.NotNil(t, ia.Options.OneAddress())
+	declined := ia.Options.OneAddress().IPv6Addr
+
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeDecline, declined)
+	assert.Equal(t, dhcpIana.StatusSuccess, status(ia))
+
+	// The declined address is withheld, even across restarts
+	require.NoError(t, closer.Close())
+	h, closer, err = setup6(testsLogger, filename, "2001:db8::/126", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	ia, _ = exchange(t, h, dhcpv6.MessageTypeRequest, declined)
+	if assert.NotNil(t, ia.Options.OneAddress()) {
+		assert.False(t, declined.Equal(ia.Options.OneAddress().IPv6Addr), "Declined address was handed out again")
+	}
+}
+
+// confirm runs a Confirm message for addrs through the handlers, and returns
+// the response
+func confirm(t *testing.T, addrs []string, handlers ...handler.ContextHandler6) *dhcpv6.Message {
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = dhcpv6.MessageTypeConfirm
+	req.AddOption(dhcpv6.OptClientID(testDuid))
+	ia := &dhcpv6.OptIANA{IaId: testIAID}
+	for _, addr := range addrs {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(addr)})
+	}
+	req.AddOption(ia)
+	var resp dhcpv6.DHCPv6
+	resp, err = dhcpv6.NewReplyFromMessage(req)
+	require.NoError(t, err)
+
+	ctx := handler.NewContext(context.Background(), testsLogger)
+	for _, h := range handlers {
+		var res handler.Result
+		resp, res = h(ctx, req, resp)
+		require.Equal(t, handler.Continue, res)
+	}
+	msg := resp.(*dhcpv6.Message)
+	assert.Empty(t, msg.Options.IANA(), "Confirm must not be answered with IAs")
+	return msg
+}
+
+func TestConfirm(t *testing.T) {
+	h, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::1:0", "2001:db8::1:ff", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+
+	for _, tt := range []struct {
+		addr string
+		code dhcpIana.StatusCode
+	}{
+		{"2001:db8::1:10", dhcpIana.StatusSuccess},
+		// Outside of the pool but on the same link
+		{"2001:db8::2:10", dhcpIana.StatusSuccess},
+		{"2001:db8:1::1:10", dhcpIana.StatusNotOnLink},
+	} {
+		msg := confirm(t, []string{tt.addr}, h)
+		if assert.NotNil(t, msg.Options.Status(), tt.addr) {
+			assert.Equal(t, tt.code, msg.Options.Status().StatusCode, tt.addr)
+		}
+	}
+
+	_, _, err = setup6(testsLogger, tempLeaseFile(t), "2001:db8::1:0", "2001:db8::1:ff", "1h", "link=2001:db8:1::/64")
+	assert.Error(t, err, "Pool outside of its link accepted")
+}
+
+// TestConfirmSeveralPools checks addresses are on-link if any of the pools
+// the request goes through has them on its link
+func TestConfirmSeveralPools(t *testing.T) {
+	first, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8::1:0", "2001:db8::1:ff", "1h")
+	require.NoError(t, err)
+	defer closer.Close()
+	second, closer, err := setup6(testsLogger, tempLeaseFile(t), "2001:db8:1::/120", "1h", "link=2001:db8:1::/64")
+	require.NoError(t, err)
+	defer closer.Close()
+
+	for _, tt := range []struct {
+		addrs []string
+		code  dhcpIana.StatusCode
+	}{
+		{[]string{"2001:db8::1:10"}, dhcpIana.StatusSuccess},
+		{[]string{"2001:db8:1::1:10"}, dhcpIana.StatusSuccess},
+		{[]string{"2001:db8::1:10", "2001:db8:1::1:10"}, dhcpIana.StatusSuccess},
+		{[]string{"2001:db8::1:10", "2001:db8:2::1:10"}, dhcpIana.StatusNotOnLink},
+	} {
+		for _, order := range [][]handler.ContextHandler6{{first, second}, {second, first}} {
+			msg := confirm(t, tt.addrs, order...)
+			if assert.NotNil(t, msg.Options.Status(), "%v", tt.addrs) {
+				assert.Equal(t, tt.code, msg.Options.Status().StatusCode, "%v", tt.addrs)
+			}
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	store, err := leasestore.NewFileStore(tempLeaseFile(t))
+	require.NoError(t, err)
+	defer store.Close()
+	alloc, err := bitmap.NewIPv6Allocator(net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ff"))
+	require.NoError(t, err)
+
+	now := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+	p := pluginState{
+		Records: map[string]*Record{
+			"expired": {IP: net.ParseIP("2001:db8::"), expires: now.Add(-time.Hour)},
+			"grace":   {IP: net.ParseIP("2001:db8::1"), expires: now.Add(-time.Minute)},
+			"active":  {IP: net.ParseIP("2001:db8::2"), expires: now.Add(time.Hour)},
+		},
+		declined: map[string]time.Time{
+			"2001:db8::3": now.Add(-time.Minute),
+			"2001:db8::4": now.Add(time.Minute),
+		},
+		GracePeriod: 10 * time.Minute,
+		store:       store,
+		allocator:   alloc,
+		log:         testsLogger,
+	}
+	for key, rec := range p.Records {
+		_, err := alloc.Allocate(leasestore.HostNet(rec.IP))
+		require.NoError(t, err)
+		require.NoError(t, saveIPAddress(store, key, rec))
+	}
+	for addr, until := range p.declined {
+		_, err := alloc.Allocate(leasestore.HostNet(net.ParseIP(addr)))
+		require.NoError(t, err)
+		require.NoError(t, saveDeclined(store, net.ParseIP(addr), until))
+	}
+
+	assert.Equal(t, 2, p.sweep(now), "Expected the expired lease and quarantine to be reclaimed")
+	assert.NotContains(t, p.Records, "expired")
+	assert.Contains(t, p.Records, "grace", "Lease within the grace period was reclaimed")
+	assert.Contains(t, p.Records, "active", "Active lease was reclaimed")
+	assert.NotContains(t, p.declined, "2001:db8::3")
+	assert.Contains(t, p.declined, "2001:db8::4", "Address in quarantine was reclaimed")
+
+	for _, addr := range []string{"2001:db8::", "2001:db8::3"} {
+		_, err = store.Load(leasestore.HostNet(net.ParseIP(addr)))
+		assert.Equal(t, leasestore.ErrNotFound, err, "Reclaimed lease %s is still stored", addr)
+		ip, err := alloc.Allocate(leasestore.HostNet(net.ParseIP(addr)))
+		require.NoError(t, err)
+		assert.True(t, ip.IP.Equal(net.ParseIP(addr)), "Reclaimed address %s was not returned to the pool", addr)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package range6
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insei/coredhcp/plugins/leasestore"
+)
+
+// declinedOwner is the owner of the stored leases recording declined
+// addresses. It can't collide with a record key, which always has a dash
+const declinedOwner = "declined"
+
+// loadRecords loads the leases held in the lease store, reserves their
+// addresses in the allocator, and drops the ones that are long expired
+func (p *pluginState) loadRecords(now time.Time) error {
+	p.Records = make(map[string]*Record)
+	var expired []net.IPNet
+	err := p.store.Iterate(func(lease *leasestore.Lease) error {
+		if ones, bits := lease.Addr.Mask.Size(); lease.Addr.IP.To4() != nil || ones != bits {
+			return fmt.Errorf("expected an IPv6 address, got: %v", lease.Addr.String())
+		}
+		rec := &Record{IP: lease.Addr.IP, expires: lease.Expires}
+		if lease.Owner == declinedOwner {
+			if lease.Expires.Before(now) {
+				expired = append(expired, lease.Addr)
+				return nil
+			}
+			p.declined[rec.IP.String()] = lease.Expires
+		} else {
+			if p.reclaimable(rec, now) {
+				expired = append(expired, lease.Addr)
+				return nil
+			}
+			p.Records[lease.Owner] = rec
+		}
+		ip, err := p.allocator.Allocate(lease.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to re-allocate leased ip %v: %v", rec.IP, err)
+		}
+		if !ip.IP.Equal(rec.IP) {
+			return fmt.Errorf("allocator did not re-allocate requested leased ip %v: %v", rec.IP, ip.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not load records: %w", err)
+	}
+	for _, addr := range expired {
+		if err := p.store.Delete(addr); err != nil {
+			return fmt.Errorf("could not delete expired lease %v: %w", addr.IP, err)
+		}
+	}
+	return nil
+}
+
+// saveIPAddress writes out a lease to storage
+func saveIPAddress(store leasestore.LeaseStore, key string, record *Record) error {
+	return store.Upsert(&leasestore.Lease{
+		Owner:   key,
+		Addr:    leasestore.HostNet(record.IP),
+		Expires: record.expires,
+	})
+}
+
+// saveDeclined records a declined address until the end of its quarantine
+func saveDeclined(store leasestore.LeaseStore, ip net.IP, until time.Time) error {
+	return store.Upsert(&leasestore.Lease{
+		Owner:   declinedOwner,
+		Addr:    leasestore.HostNet(ip),
+		Expires: until,
+	})
+}
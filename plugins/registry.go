@@ -0,0 +1,71 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Registry holds the plugins a server can load, by name. Servers built from
+// different registries can run in the same program with different plugins,
+// or different plugins under the same name
+type Registry struct {
+	mu      sync.RWMutex
+	plugins map[string]*Plugin
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{plugins: make(map[string]*Plugin)}
+}
+
+// DefaultRegistry is the registry of RegisterPlugin, Load, Reload and
+// LoadPlugins. It holds the plugins of RegisteredPlugins
+var DefaultRegistry = &Registry{plugins: RegisteredPlugins}
+
+// Register adds a plugin to the registry. It fails if a plugin with the same
+// name is already registered
+func (r *Registry) Register(plugin *Plugin) error {
+	if plugin == nil {
+		return errors.New("cannot register nil plugin")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.plugins[plugin.Name]; ok {
+		return fmt.Errorf("plugin '%s' is already registered", plugin.Name)
+	}
+	r.plugins[plugin.Name] = plugin
+	return nil
+}
+
+// Get returns the plugin registered under a name, or nil if there is none
+func (r *Registry) Get(name string) *Plugin {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.plugins[name]
+}
+
+// Names returns the names of the registered plugins, sorted
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.plugins))
+	for name := range r.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load is like the Load function, with the plugins of the registry
+func (r *Registry) Load(serverLogger logrus.FieldLogger, conf *config.Config) (*Chain, error) {
+	return r.Reload(serverLogger, conf, nil)
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hostnamePlugin returns a plugin setting the server host name of responses
+func hostnamePlugin(name, hostname string) *Plugin {
+	return &Plugin{
+		Name: name,
+		Setup4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, error) {
+			return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+				resp.ServerHostName = hostname
+				return resp, true
+			}, nil
+		},
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	log := logger.GetLogger("tests")
+	first, second := NewRegistry(), NewRegistry()
+	require.NoError(t, first.Register(hostnamePlugin("test_registry", "first")))
+	require.NoError(t, second.Register(hostnamePlugin("test_registry", "second")))
+	require.NoError(t, second.Register(hostnamePlugin("test_other", "other")))
+	assert.Error(t, first.Register(hostnamePlugin("test_registry", "again")), "Duplicate plugin registered")
+	assert.Error(t, first.Register(nil))
+	assert.Equal(t, []string{"test_other", "test_registry"}, second.Names())
+	assert.Nil(t, DefaultRegistry.Get("test_registry"), "Registry leaked into the default one")
+
+	// The same configuration loads the plugins of each registry
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "test_registry"},
+	}}}
+	for reg, hostname := range map[*Registry]string{first: "first", second: "second"} {
+		handlers4, _, err := reg.LoadPlugins(log, conf)
+		require.NoError(t, err)
+		require.Len(t, handlers4, 1)
+		req, err := dhcpv4.NewDiscovery(nil)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		resp, stop := handlers4[0](req, resp)
+		assert.True(t, stop)
+		assert.Equal(t, hostname, resp.ServerHostName)
+	}
+
+	conf.Server4.Plugins[0].Name = "test_other"
+	_, err := first.Load(log, conf)
+	assert.Error(t, err, "Plugin of another registry loaded")
+	_, err = second.Load(log, conf)
+	assert.NoError(t, err)
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	var closed []string
+	registerTestPlugin(t, "test_default", &closed)
+	assert.NotNil(t, DefaultRegistry.Get("test_default"), "RegisteredPlugins not in the default registry")
+
+	require.NoError(t, RegisterPlugin(logger.GetLogger("tests"), hostnamePlugin("test_register", "")))
+	t.Cleanup(func() { delete(RegisteredPlugins, "test_register") })
+	assert.Contains(t, RegisteredPlugins, "test_register")
+	assert.Panics(t, func() {
+		_ = RegisterPlugin(logger.GetLogger("tests"), hostnamePlugin("test_register", ""))
+	})
+}
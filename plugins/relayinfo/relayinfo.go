@@ -0,0 +1,49 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package relayinfo parses the relay agent information option (option 82,
+// RFC 3046) of DHCPv4 requests, for plugins to make decisions on where
+// requests come from. The server echoes the option back in every reply, so
+// plugins don't need to.
+package relayinfo
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Info holds the sub-options of the relay agent information option
+type Info struct {
+	// CircuitID identifies the circuit the relay received the request on
+	CircuitID []byte
+	// RemoteID identifies the remote end of the circuit
+	RemoteID []byte
+	// LinkSelection is the subnet the client is on, when it differs from the
+	// relay address (RFC 3527). It is nil if absent or malformed
+	LinkSelection net.IP
+	// SubscriberID identifies the subscriber (RFC 3993)
+	SubscriberID string
+	// Options holds all the sub-options, including the ones above
+	Options dhcpv4.Options
+}
+
+// FromRequest parses the relay agent information option of a request. It
+// returns nil if the request has none, or if it is malformed
+func FromRequest(req *dhcpv4.DHCPv4) *Info {
+	rai := req.RelayAgentInfo()
+	if rai == nil {
+		return nil
+	}
+	info := &Info{
+		CircuitID:    rai.Get(dhcpv4.AgentCircuitIDSubOption),
+		RemoteID:     rai.Get(dhcpv4.AgentRemoteIDSubOption),
+		SubscriberID: string(rai.Get(dhcpv4.SubscriberIDSubOption)),
+		Options:      rai.Options,
+	}
+	if ls := rai.Get(dhcpv4.LinkSelectionSubOption); len(ls) == net.IPv4len {
+		info.LinkSelection = net.IP(ls)
+	}
+	return info
+}
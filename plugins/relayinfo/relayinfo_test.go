@@ -0,0 +1,46 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package relayinfo
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromRequest(t *testing.T) {
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	assert.Nil(t, FromRequest(req), "Info returned without option 82")
+
+	req.UpdateOption(dhcpv4.OptRelayAgentInfo(
+		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0:10")),
+		dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte{0xaa, 0xbb}),
+		dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, []byte{192, 0, 2, 0}),
+		dhcpv4.OptGeneric(dhcpv4.SubscriberIDSubOption, []byte("customer-42")),
+		dhcpv4.OptGeneric(dhcpv4.RelayAgentFlagsSubOption, []byte{0x80}),
+	))
+	// Parse the request as received on the wire
+	req, err = dhcpv4.FromBytes(req.ToBytes())
+	require.NoError(t, err)
+	info := FromRequest(req)
+	require.NotNil(t, info)
+	assert.Equal(t, []byte("eth0:10"), info.CircuitID)
+	assert.Equal(t, []byte{0xaa, 0xbb}, info.RemoteID)
+	assert.True(t, info.LinkSelection.Equal(net.IPv4(192, 0, 2, 0)))
+	assert.Equal(t, "customer-42", info.SubscriberID)
+	assert.Equal(t, []byte{0x80}, info.Options.Get(dhcpv4.RelayAgentFlagsSubOption))
+
+	req.UpdateOption(dhcpv4.OptRelayAgentInfo(
+		dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, []byte{192, 0, 2}),
+	))
+	info = FromRequest(req)
+	require.NotNil(t, info)
+	assert.Nil(t, info.LinkSelection, "Malformed link selection accepted")
+	assert.Nil(t, info.CircuitID)
+}
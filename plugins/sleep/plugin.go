@@ -8,6 +8,7 @@ package sleep
 
 import (
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/insei/coredhcp/handler"
@@ -34,12 +35,15 @@ const pluginName = "sleep"
 //
 // For the duration format, see the documentation of `time.ParseDuration`,
 // https://golang.org/pkg/time/#ParseDuration .
+//
+// The delay is cut short when the request times out, in which case it isn't
+// answered.
 
 // Plugin contains the `sleep` plugin data.
 var Plugin = plugins.Plugin{
-	Name:   pluginName,
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:         pluginName,
+	InitContext6: setup6,
+	InitContext4: setup4,
 }
 
 type pluginState struct {
@@ -47,54 +51,72 @@ type pluginState struct {
 	log   logrus.FieldLogger
 }
 
-func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.Handler6, error) {
+func setup6(serverLogger logrus.FieldLogger, args ...string) (handler.ContextHandler6, io.Closer, error) {
 	if len(args) != 1 {
-		return nil, fmt.Errorf("want exactly one argument, got %d", len(args))
+		return nil, nil, fmt.Errorf("want exactly one argument, got %d", len(args))
 	}
 	delay, err := time.ParseDuration(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse duration: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse duration: %w", err)
 	}
 	pState := &pluginState{
 		delay: delay,
 		log:   logger.CreatePluginLogger(serverLogger, pluginName, true),
 	}
 	pState.log.Printf("loaded plugin for DHCPv6.")
-	return makeSleepHandler6(pState), nil
+	return makeSleepHandler6(pState), nil, nil
 }
 
-func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.Handler4, error) {
+func setup4(serverLogger logrus.FieldLogger, args ...string) (handler.ContextHandler4, io.Closer, error) {
 	if len(args) != 1 {
-		return nil, fmt.Errorf("want exactly one argument, got %d", len(args))
+		return nil, nil, fmt.Errorf("want exactly one argument, got %d", len(args))
 	}
 	delay, err := time.ParseDuration(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse duration: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse duration: %w", err)
 	}
 	pState := &pluginState{
 		delay: delay,
 		log:   logger.CreatePluginLogger(serverLogger, pluginName, true),
 	}
 	pState.log.Printf("loaded plugin for DHCPv4.")
-	return makeSleepHandler4(pState), nil
+	return makeSleepHandler4(pState), nil, nil
 }
 
-func makeSleepHandler6(pState *pluginState) handler.Handler6 {
-	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+func makeSleepHandler6(pState *pluginState) handler.ContextHandler6 {
+	return func(ctx *handler.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, handler.Result) {
 		pState.log.Printf("introducing delay of %s in response", pState.delay)
+		if !pState.sleep(ctx) {
+			return nil, handler.Drop("timed out")
+		}
 		// return the unmodified response, and instruct coredhcp to continue to
 		// the next plugin.
-		time.Sleep(pState.delay)
-		return resp, false
+		return resp, handler.Continue
 	}
 }
 
-func makeSleepHandler4(pState *pluginState) handler.Handler4 {
-	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+func makeSleepHandler4(pState *pluginState) handler.ContextHandler4 {
+	return func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
 		pState.log.Printf("introducing delay of %s in response", pState.delay)
+		if !pState.sleep(ctx) {
+			return nil, handler.Drop("timed out")
+		}
 		// return the unmodified response, and instruct coredhcp to continue to
 		// the next plugin.
-		time.Sleep(pState.delay)
-		return resp, false
+		return resp, handler.Continue
+	}
+}
+
+// sleep waits for the delay, and returns false if the request timed out
+// before then
+func (p *pluginState) sleep(ctx *handler.Context) bool {
+	timer := time.NewTimer(p.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		ctx.Log.Printf("request timed out during the delay, dropping it")
+		return false
 	}
 }
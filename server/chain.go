@@ -0,0 +1,54 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/insei/coredhcp/plugins"
+)
+
+// chain is a loaded plugin chain, along with the requests it is handling
+type chain struct {
+	*plugins.Chain
+	inflight sync.WaitGroup
+}
+
+// release marks a request acquired with activeChain.acquire as handled
+func (c *chain) release() {
+	c.inflight.Done()
+}
+
+// activeChain holds the chain handling new requests, which is replaced when
+// the configuration is reloaded
+type activeChain struct {
+	mu      sync.RWMutex
+	current *chain
+}
+
+// acquire returns the current chain to handle a request with. The request
+// must be released once handled
+func (a *activeChain) acquire() *chain {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.current.inflight.Add(1)
+	return a.current
+}
+
+// swap makes c the chain handling new requests, and returns the previous one
+func (a *activeChain) swap(c *chain) *chain {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.current
+	a.current = c
+	return old
+}
+
+// get returns the current chain, without acquiring it
+func (a *activeChain) get() *chain {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.current
+}
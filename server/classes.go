@@ -0,0 +1,185 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insei/coredhcp/plugins/relayinfo"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// interfaceName returns a function returning the name of the interface a
+// request was received on, or "" if unknown. The interface is only looked up
+// once, and only if needed
+func interfaceName(ctx *handler.Context) func() string {
+	var name *string
+	return func() string {
+		if name == nil {
+			var n string
+			if ifi, err := ctx.Interface(); err == nil {
+				n = ifi.Name
+			}
+			name = &n
+		}
+		return *name
+	}
+}
+
+// inClass4 tells whether a DHCPv4 request meets all the criteria of a class
+func inClass4(m *config.ClassMatch, req *dhcpv4.DHCPv4, ifName func() string) bool {
+	if m.VendorClass != "" && !strings.HasPrefix(req.ClassIdentifier(), m.VendorClass) {
+		return false
+	}
+	if m.UserClass != "" && !hasUserClass(req.UserClass(), m.UserClass) {
+		return false
+	}
+	if m.OUI != nil && !bytes.HasPrefix(req.ClientHWAddr, m.OUI) {
+		return false
+	}
+	if m.HardwareType != 0 && uint16(req.HWType) != m.HardwareType {
+		return false
+	}
+	if m.Interface != "" && ifName() != m.Interface {
+		return false
+	}
+	if m.CircuitID != "" {
+		info := relayinfo.FromRequest(req)
+		if info == nil || string(info.CircuitID) != m.CircuitID {
+			return false
+		}
+	}
+	return true
+}
+
+func hasUserClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// inClass6 tells whether a DHCPv6 request meets all the criteria of a class.
+// d is the request as received, and msg the client message it contains
+func inClass6(m *config.ClassMatch, d dhcpv6.DHCPv6, msg *dhcpv6.Message, ifName func() string) bool {
+	if m.VendorClass != "" && !hasVendorClass6(msg, m.VendorClass) {
+		return false
+	}
+	if m.UserClass != "" {
+		found := false
+		for _, c := range msg.Options.UserClasses() {
+			if string(c) == m.UserClass {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.OUI != nil || m.HardwareType != 0 {
+		htype, addr := hwAddr6(d, msg)
+		if m.OUI != nil && !bytes.HasPrefix(addr, m.OUI) {
+			return false
+		}
+		if m.HardwareType != 0 && uint16(htype) != m.HardwareType {
+			return false
+		}
+	}
+	if m.Interface != "" && ifName() != m.Interface {
+		return false
+	}
+	if m.CircuitID != "" {
+		relay := innermostRelay(d)
+		if relay == nil || string(relay.Options.InterfaceID()) != m.CircuitID {
+			return false
+		}
+	}
+	return true
+}
+
+// hasVendorClass6 tells whether one of the vendor class data of a request
+// starts with prefix
+func hasVendorClass6(msg *dhcpv6.Message, prefix string) bool {
+	for _, opt := range msg.Options.Get(dhcpv6.OptionVendorClass) {
+		vc, ok := opt.(*dhcpv6.OptVendorClass)
+		if !ok {
+			continue
+		}
+		for _, data := range vc.Data {
+			if strings.HasPrefix(string(data), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hwAddr6 returns the hardware type and address of a DHCPv6 client, from the
+// client link-layer address option of the relay closest to it (RFC 6939), or
+// else from its DUID. The address is nil if unknown
+func hwAddr6(d dhcpv6.DHCPv6, msg *dhcpv6.Message) (iana.HWType, []byte) {
+	if relay := innermostRelay(d); relay != nil {
+		if htype, addr := relay.Options.ClientLinkLayerAddress(); addr != nil {
+			return htype, addr
+		}
+	}
+	if duid := msg.Options.ClientID(); duid != nil && (duid.Type == dhcpv6.DUID_LL || duid.Type == dhcpv6.DUID_LLT) {
+		return duid.HwType, duid.LinkLayerAddr
+	}
+	return 0, nil
+}
+
+// innermostRelay returns the relay closest to the client, or nil if the
+// request wasn't relayed
+func innermostRelay(d dhcpv6.DHCPv6) *dhcpv6.RelayMessage {
+	if !d.IsRelay() {
+		return nil
+	}
+	inner, err := dhcpv6.DecapsulateRelayIndex(d, -1)
+	if err != nil {
+		return nil
+	}
+	return inner.(*dhcpv6.RelayMessage)
+}
+
+// classes4 returns handlers followed by the handlers of the classes a request
+// is in. handlers isn't modified
+func classes4(ctx *handler.Context, chain *plugins.Chain, req *dhcpv4.DHCPv4, handlers []plugins.NamedHandler4) []plugins.NamedHandler4 {
+	ifName := interfaceName(ctx)
+	// Copy the handlers on the first append, they're shared by all requests
+	handlers = handlers[:len(handlers):len(handlers)]
+	for i := range chain.Classes4 {
+		class := &chain.Classes4[i]
+		if inClass4(&class.Match, req, ifName) {
+			ctx.Log.Debugf("Request in class %s", class.Name)
+			handlers = append(handlers, class.Handlers...)
+		}
+	}
+	return handlers
+}
+
+// classes6 behaves like classes4, but for DHCPv6 requests
+func classes6(ctx *handler.Context, chain *plugins.Chain, d dhcpv6.DHCPv6, msg *dhcpv6.Message, handlers []plugins.NamedHandler6) []plugins.NamedHandler6 {
+	ifName := interfaceName(ctx)
+	// Copy the handlers on the first append, they're shared by all requests
+	handlers = handlers[:len(handlers):len(handlers)]
+	for i := range chain.Classes6 {
+		class := &chain.Classes6[i]
+		if inClass6(&class.Match, d, msg, ifName) {
+			ctx.Log.Debugf("Request in class %s", class.Name)
+			handlers = append(handlers, class.Handlers...)
+		}
+	}
+	return handlers
+}
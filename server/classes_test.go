@@ -0,0 +1,114 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInClass4(t *testing.T) {
+	ifName := func() string { return "eth1" }
+	pxe, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x1a, 0x2b, 3, 4, 5},
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016")),
+		dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionUserClassInformation, Value: dhcpv4.Strings{"iPXE", "lab"}}),
+		dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1)),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0:10")))),
+	)
+	require.NoError(t, err)
+	// Parse the request as received on the wire
+	pxe, err = dhcpv4.FromBytes(pxe.ToBytes())
+	require.NoError(t, err)
+	plain, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x00, 0x1a, 0x2c, 3, 4, 5})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name  string
+		match config.ClassMatch
+		pxe   bool
+		plain bool
+	}{
+		{"vendor class", config.ClassMatch{VendorClass: "PXEClient"}, true, false},
+		{"user class", config.ClassMatch{UserClass: "lab"}, true, false},
+		{"oui", config.ClassMatch{OUI: []byte{0x00, 0x1a, 0x2b}}, true, false},
+		{"hardware type", config.ClassMatch{HardwareType: uint16(iana.HWTypeEthernet)}, true, true},
+		{"interface", config.ClassMatch{Interface: "eth1"}, true, true},
+		{"other interface", config.ClassMatch{Interface: "eth2"}, false, false},
+		{"circuit-id", config.ClassMatch{CircuitID: "eth0:10"}, true, false},
+		{"all criteria", config.ClassMatch{VendorClass: "PXEClient", OUI: []byte{0x00, 0x1a, 0x2b}, HardwareType: 6}, false, false},
+	} {
+		assert.Equal(t, tt.pxe, inClass4(&tt.match, pxe, ifName), tt.name)
+		assert.Equal(t, tt.plain, inClass4(&tt.match, plain, ifName), tt.name)
+	}
+}
+
+func TestInClass6(t *testing.T) {
+	ifName := func() string { return "eth1" }
+	mac := net.HardwareAddr{0x00, 0x1a, 0x2b, 3, 4, 5}
+	solicit, err := dhcpv6.NewSolicit(mac)
+	require.NoError(t, err)
+	solicit.AddOption(&dhcpv6.OptVendorClass{EnterpriseNumber: 9, Data: [][]byte{[]byte("Cisco IP Phone")}})
+	solicit.AddOption(&dhcpv6.OptUserClass{UserClasses: [][]byte{[]byte("voice")}})
+	relay, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+	require.NoError(t, err)
+	relay.AddOption(dhcpv6.OptInterfaceID([]byte("eth0.2")))
+	relay.AddOption(dhcpv6.OptClientLinkLayerAddress(iana.HWTypeEthernet, net.HardwareAddr{0x00, 0x1a, 0x2c, 3, 4, 5}))
+
+	for _, tt := range []struct {
+		name    string
+		match   config.ClassMatch
+		direct  bool
+		relayed bool
+	}{
+		{"vendor class", config.ClassMatch{VendorClass: "Cisco"}, true, true},
+		{"other vendor class", config.ClassMatch{VendorClass: "PXEClient"}, false, false},
+		{"user class", config.ClassMatch{UserClass: "voice"}, true, true},
+		// The client link-layer address of the relay is preferred to the DUID
+		{"oui", config.ClassMatch{OUI: []byte{0x00, 0x1a, 0x2b}}, true, false},
+		{"relay oui", config.ClassMatch{OUI: []byte{0x00, 0x1a, 0x2c}}, false, true},
+		{"hardware type", config.ClassMatch{HardwareType: uint16(iana.HWTypeEthernet)}, true, true},
+		{"interface", config.ClassMatch{Interface: "eth1"}, true, true},
+		{"interface-id", config.ClassMatch{CircuitID: "eth0.2"}, false, true},
+	} {
+		assert.Equal(t, tt.direct, inClass6(&tt.match, solicit, solicit, ifName), tt.name)
+		assert.Equal(t, tt.relayed, inClass6(&tt.match, relay, solicit, ifName), tt.name)
+	}
+}
+
+func TestClasses4(t *testing.T) {
+	named := func(name string) plugins.NamedHandler4 {
+		return plugins.NamedHandler4{Name: name}
+	}
+	chain := &plugins.Chain{
+		Handlers4: []plugins.NamedHandler4{named("server")},
+		Classes4: []plugins.Class4{
+			{Name: "pxe", Match: config.ClassMatch{VendorClass: "PXEClient"}, Handlers: []plugins.NamedHandler4{named("nbp")}},
+			{Name: "phones", Match: config.ClassMatch{VendorClass: "Cisco"}, Handlers: []plugins.NamedHandler4{named("dns")}},
+			{Name: "lab", Match: config.ClassMatch{OUI: []byte{0, 1, 2}}, Handlers: []plugins.NamedHandler4{named("mtu"), named("router")}},
+		},
+	}
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient")))
+	require.NoError(t, err)
+
+	ctx := handler.NewContext(context.Background(), testsLogger)
+	handlers := classes4(ctx, chain, req, chain.Handlers4)
+	var names []string
+	for _, h := range handlers {
+		names = append(names, h.Name)
+	}
+	assert.Equal(t, []string{"server", "nbp", "mtu", "router"}, names)
+	assert.Len(t, chain.Handlers4, 1, "The server-wide handlers were modified")
+}
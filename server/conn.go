@@ -0,0 +1,81 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// conn6 is the connection of a DHCPv6 listener: an ipv6.PacketConn for UDP
+// sockets, or a plainConn6 for other connections
+type conn6 interface {
+	ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error)
+	WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (int, error)
+	ReadBatch(ms []ipv6.Message, flags int) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// conn4 is like conn6, for DHCPv4 listeners
+type conn4 interface {
+	ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error)
+	WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error)
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// plainConn6 adapts a connection the ipv6 package can't handle, like one that
+// isn't backed by a socket, to conn6. It has no control messages: requests
+// come from an unknown interface unless the listener is bound to one, and
+// responses go out following the routing table. Batches hold one datagram
+type plainConn6 struct {
+	net.PacketConn
+}
+
+func (c plainConn6) ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	return n, nil, addr, err
+}
+
+func (c plainConn6) WriteTo(b []byte, _ *ipv6.ControlMessage, dst net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+func (c plainConn6) ReadBatch(ms []ipv6.Message, _ int) (int, error) {
+	n, addr, err := c.PacketConn.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].NN, ms[0].Addr = n, 0, addr
+	return 1, nil
+}
+
+// plainConn4 is like plainConn6, for DHCPv4 listeners. Without the interface
+// of requests, replies to clients that have no address yet are broadcast
+type plainConn4 struct {
+	net.PacketConn
+}
+
+func (c plainConn4) ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	return n, nil, addr, err
+}
+
+func (c plainConn4) WriteTo(b []byte, _ *ipv4.ControlMessage, dst net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, dst)
+}
+
+func (c plainConn4) ReadBatch(ms []ipv4.Message, _ int) (int, error) {
+	n, addr, err := c.PacketConn.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].NN, ms[0].Addr = n, 0, addr
+	return 1, nil
+}
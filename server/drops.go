@@ -0,0 +1,136 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/sirupsen/logrus"
+)
+
+// reasonPanic is the drop reason of the requests a plugin panicked on
+const reasonPanic = "panic"
+
+// dropCounter counts the requests dropped by plugins, by plugin and reason,
+// and the panics recovered from while handling requests
+type dropCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]uint64
+	panics uint64
+}
+
+// drop logs and counts a request dropped by a plugin
+func (d *dropCounter) drop(ctx *handler.Context, plugin, reason string) {
+	ctx.Log.Printf("Plugin %s dropped the request: %s", plugin, reason)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[string]map[string]uint64)
+	}
+	if d.counts[plugin] == nil {
+		d.counts[plugin] = make(map[string]uint64)
+	}
+	d.counts[plugin][reason]++
+}
+
+// panicked logs and counts a panic recovered from while handling a request.
+// plugin is empty if the panic didn't happen in a plugin
+func (d *dropCounter) panicked(log logrus.FieldLogger, plugin, summary string, p interface{}) {
+	where := "the server"
+	if plugin != "" {
+		where = "plugin " + plugin
+	}
+	log.Errorf("Recovered from a panic in %s: %v\nRequest: %s\n%s", where, p, summary, debug.Stack())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.panics++
+}
+
+// panicCount returns the number of panics recovered from
+func (d *dropCounter) panicCount() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.panics
+}
+
+// snapshot returns a copy of the counts
+func (d *dropCounter) snapshot() map[string]map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[string]map[string]uint64, len(d.counts))
+	for plugin, reasons := range d.counts {
+		counts[plugin] = make(map[string]uint64, len(reasons))
+		for reason, n := range reasons {
+			counts[plugin][reason] = n
+		}
+	}
+	return counts
+}
+
+// runChain6 runs the handlers on a request. It returns the response, or false
+// if a plugin dropped the request. A plugin panicking drops the request
+func (d *dropCounter) runChain6(ctx *handler.Context, handlers []plugins.NamedHandler6, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	for _, h := range handlers {
+		var res handler.Result
+		resp, res = d.call6(ctx, h, req, resp)
+		switch {
+		case res.Action == handler.ActionDrop:
+			d.drop(ctx, h.Name, res.Reason)
+			return nil, false
+		case resp == nil:
+			d.drop(ctx, h.Name, handler.ReasonNoResponse)
+			return nil, false
+		case res.Action == handler.ActionRespond:
+			return resp, true
+		}
+	}
+	return resp, true
+}
+
+// runChain4 behaves like runChain6, but for DHCPv4 requests
+func (d *dropCounter) runChain4(ctx *handler.Context, handlers []plugins.NamedHandler4, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	for _, h := range handlers {
+		var res handler.Result
+		resp, res = d.call4(ctx, h, req, resp)
+		switch {
+		case res.Action == handler.ActionDrop:
+			d.drop(ctx, h.Name, res.Reason)
+			return nil, false
+		case resp == nil:
+			d.drop(ctx, h.Name, handler.ReasonNoResponse)
+			return nil, false
+		case res.Action == handler.ActionRespond:
+			return resp, true
+		}
+	}
+	return resp, true
+}
+
+// call6 runs a handler, turning a panic into a drop
+func (d *dropCounter) call6(ctx *handler.Context, h plugins.NamedHandler6, req, resp dhcpv6.DHCPv6) (_ dhcpv6.DHCPv6, res handler.Result) {
+	defer func() {
+		if p := recover(); p != nil {
+			d.panicked(ctx.Log, h.Name, req.Summary(), p)
+			res = handler.Drop(reasonPanic)
+		}
+	}()
+	return h.Handler(ctx, req, resp)
+}
+
+// call4 behaves like call6, but for DHCPv4 requests
+func (d *dropCounter) call4(ctx *handler.Context, h plugins.NamedHandler4, req, resp *dhcpv4.DHCPv4) (_ *dhcpv4.DHCPv4, res handler.Result) {
+	defer func() {
+		if p := recover(); p != nil {
+			d.panicked(ctx.Log, h.Name, req.Summary(), p)
+			res = handler.Drop(reasonPanic)
+		}
+	}()
+	return h.Handler(ctx, req, resp)
+}
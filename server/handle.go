@@ -5,23 +5,42 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 )
 
 // HandleMsg6 runs for every received DHCPv6 packet. It will run every
 // registered handler in sequence, and reply with the resulting response.
-// It will not reply if the resulting response is `nil`.
-func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.UDPAddr) {
+// It will not reply if the resulting response is `nil`, or if handling the
+// request panicked.
+func (l *listener6) HandleMsg6(chain *plugins.Chain, buf []byte, oob *ipv6.ControlMessage, peer *net.UDPAddr) {
+	var d dhcpv6.DHCPv6
+	defer func() {
+		if p := recover(); p != nil {
+			summary := fmt.Sprintf("undecoded datagram from %v", peer)
+			if d != nil {
+				summary = d.Summary()
+			}
+			l.drops.panicked(l.log, "", summary, p)
+		}
+	}()
+
 	d, err := dhcpv6.FromBytes(buf)
-	bufpool.Put(&buf)
+	putBuffer(buf)
 	if err != nil {
 		l.log.Printf("Error parsing DHCPv6 request: %v", err)
 		return
@@ -46,6 +65,8 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRenew,
 		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeInformationRequest:
 		resp, err = dhcpv6.NewReplyFromMessage(msg)
+	case dhcpv6.MessageTypeDecline:
+		resp, err = newReplyFromDecline(msg)
 	default:
 		err = fmt.Errorf("MainHandler6: message type %d not supported", msg.Type())
 	}
@@ -54,15 +75,44 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 		return
 	}
 
-	var stop bool
-	for _, handler := range l.handlers {
-		resp, stop = handler(d, resp)
-		if stop {
+	// Listeners with their own plugins don't use links or classes
+	handlers, own := chain.Listeners6[l.addr]
+	ok := true
+	if !own {
+		handlers, ok = l.handlers6(chain, d, oob)
+	}
+	if !ok {
+		return
+	}
+	ifIndex := l.Interface.Index
+	if ifIndex == 0 && oob != nil {
+		ifIndex = oob.IfIndex
+	}
+	ctx, cancel := newContext(l.timeout, l.log.WithField("xid", msg.TransactionID.String()), ifIndex, peer)
+	defer cancel()
+	for r := d; r.IsRelay(); {
+		relay := r.(*dhcpv6.RelayMessage)
+		ctx.Relays = append(ctx.Relays, relay)
+		if r, err = dhcpv6.DecapsulateRelay(relay); err != nil {
 			break
 		}
 	}
-	if resp == nil {
-		l.log.Print("MainHandler6: dropping request because response is nil")
+	if !own && len(chain.Classes6) > 0 {
+		handlers = classes6(ctx, chain, d, msg, handlers)
+	}
+
+	resp, ok = l.drops.runChain6(ctx, handlers, d, resp)
+	if !ok {
+		return
+	}
+	if ctx.Err() != nil {
+		l.log.Printf("MainHandler6: dropping response to %s: %v", msg.Type(), ctx.Err())
+		return
+	}
+	if msg.Type() == dhcpv6.MessageTypeConfirm && resp.GetOneOption(dhcpv6.OptionStatusCode) == nil {
+		// No plugin knows the prefixes of the client's link, or the client
+		// sent no address. Either way there must be no reply (RFC8415 §18.3.3)
+		l.log.Debugf("MainHandler6: not answering Confirm, on-link status is unknown")
 		return
 	}
 
@@ -71,12 +121,15 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 		if rmsg, ok := resp.(*dhcpv6.Message); !ok {
 			l.log.Warningf("DHCPv6: response is a relayed message, not reencapsulating")
 		} else {
-			tmp, err := dhcpv6.NewRelayReplFromRelayForw(d.(*dhcpv6.RelayMessage), rmsg)
+			forw := d.(*dhcpv6.RelayMessage)
+			tmp, err := dhcpv6.NewRelayReplFromRelayForw(forw, rmsg)
 			if err != nil {
 				l.log.Warningf("DHCPv6: cannot create relay-repl from relay-forw: %v", err)
 				return
 			}
+			echoRelayPorts(forw, tmp.(*dhcpv6.RelayMessage))
 			resp = tmp
+			peer = &net.UDPAddr{IP: peer.IP, Port: relayPort6(forw, peer), Zone: peer.Zone}
 		}
 	}
 
@@ -98,15 +151,87 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 	}
 }
 
-func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr) {
+// relayPort6 returns the port to send the Relay-Reply to a Relay-Forward on:
+// the source port of the relay if it included a Relay Source Port option, the
+// server port otherwise (RFC 8357 §5.2)
+func relayPort6(forw *dhcpv6.RelayMessage, peer *net.UDPAddr) int {
+	if forw.GetOneOption(dhcpv6.OptionRelayPort) != nil && peer.Port != 0 {
+		return peer.Port
+	}
+	return dhcpv6.DefaultServerPort
+}
+
+// echoRelayPorts copies the Relay Source Port option of each relay of a
+// Relay-Forward to the matching level of its Relay-Reply, which
+// dhcpv6.NewRelayReplFromRelayForw doesn't do. The relays need them to forward
+// the reply to the port their downstream relay sent from (RFC 8357 §5.1)
+func echoRelayPorts(forw, repl *dhcpv6.RelayMessage) {
+	for {
+		if opt := forw.GetOneOption(dhcpv6.OptionRelayPort); opt != nil {
+			repl.AddOption(opt)
+		}
+		innerForw, ok := forw.Options.RelayMessage().(*dhcpv6.RelayMessage)
+		if !ok {
+			return
+		}
+		innerRepl, ok := repl.Options.RelayMessage().(*dhcpv6.RelayMessage)
+		if !ok {
+			return
+		}
+		forw, repl = innerForw, innerRepl
+	}
+}
+
+// newReplyFromDecline builds the Reply to a Decline message, which
+// dhcpv6.NewReplyFromMessage doesn't support
+func newReplyFromDecline(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	cid := msg.GetOneOption(dhcpv6.OptionClientID)
+	if cid == nil {
+		return nil, errors.New("Client ID cannot be nil when building REPLY")
+	}
+	rep := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	rep.AddOption(cid)
+	return rep, nil
+}
+
+// relaySourcePortSubOption is the Relay Agent Source Port sub-option of the
+// relay agent information option (RFC 8357)
+const relaySourcePortSubOption = dhcpv4.GenericOptionCode(19)
+
+// relayPort4 returns the port to reply to a relayed request on: the source port
+// of the relay if it asked for it with the Relay Agent Source Port sub-option,
+// the server port otherwise (RFC 8357 §5.2)
+func relayPort4(req *dhcpv4.DHCPv4, peer net.Addr) int {
+	if rai := req.RelayAgentInfo(); rai != nil && rai.Has(relaySourcePortSubOption) {
+		if udpPeer, ok := peer.(*net.UDPAddr); ok && udpPeer.Port != 0 {
+			return udpPeer.Port
+		}
+	}
+	return dhcpv4.ServerPort
+}
+
+func (l *listener4) HandleMsg4(chain *plugins.Chain, buf []byte, oob *ipv4.ControlMessage, src net.Addr) {
 	var (
 		resp, tmp *dhcpv4.DHCPv4
 		err       error
-		stop      bool
+		ok        bool
+		req       *dhcpv4.DHCPv4
 	)
+	defer func() {
+		if p := recover(); p != nil {
+			summary := fmt.Sprintf("undecoded datagram from %v", src)
+			if req != nil {
+				summary = req.Summary()
+			}
+			l.drops.panicked(l.log, "", summary, p)
+		}
+	}()
 
-	req, err := dhcpv4.FromBytes(buf)
-	bufpool.Put(&buf)
+	req, err = dhcpv4.FromBytes(buf)
+	putBuffer(buf)
 	if err != nil {
 		l.log.Printf("Error parsing DHCPv4 request: %v", err)
 		return
@@ -124,111 +249,310 @@ func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.A
 	switch mt := req.MessageType(); mt {
 	case dhcpv4.MessageTypeDiscover:
 		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
-	case dhcpv4.MessageTypeRequest:
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
 		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		// Nothing is sent back (RFC2131 §4.3.2), but plugins still need to
+		// know about these to update their state
 	default:
 		l.log.Printf("plugins/server: Unhandled message type: %v", mt)
 		return
 	}
 
-	resp = tmp
-	for _, handler := range l.handlers {
-		resp, stop = handler(req, resp)
-		if stop {
-			break
-		}
+	// Listeners with their own plugins don't use subnets or classes
+	handlers, own := chain.Listeners4[l.addr]
+	ok = true
+	if !own {
+		handlers, ok = l.handlers4(chain, req, oob)
+	}
+	if !ok {
+		return
+	}
+	ifIndex := l.Interface.Index
+	if ifIndex == 0 && oob != nil {
+		ifIndex = oob.IfIndex
+	}
+	ctx, cancel := newContext(l.timeout, l.log.WithField("xid", req.TransactionID.String()), ifIndex, src)
+	defer cancel()
+	if !own && len(chain.Classes4) > 0 {
+		handlers = classes4(ctx, chain, req, handlers)
 	}
 
-	if resp != nil {
-		useEthernet := false
-		var peer *net.UDPAddr
-		if !req.GatewayIPAddr.IsUnspecified() {
-			// TODO: make RFC8357 compliant
-			peer = &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
-		} else if resp.MessageType() == dhcpv4.MessageTypeNak {
-			peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
-		} else if !req.ClientIPAddr.IsUnspecified() {
-			peer = &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
-		} else if req.IsBroadcast() {
-			peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
-		} else {
-			//sends a layer2 frame so that we can define the destination MAC address
-			peer = &net.UDPAddr{IP: resp.YourIPAddr, Port: dhcpv4.ClientPort}
-			useEthernet = true
-		}
-
-		var woob *ipv4.ControlMessage
-		if peer.IP.Equal(net.IPv4bcast) || peer.IP.IsLinkLocalUnicast() || useEthernet {
-			// Direct broadcasts, link-local and layer2 unicasts to the interface the request was
-			// received on. Other packets should use the normal routing table in
-			// case of asymetric routing
-			switch {
-			case l.Interface.Index != 0:
-				woob = &ipv4.ControlMessage{IfIndex: l.Interface.Index}
-			case oob != nil && oob.IfIndex != 0:
-				woob = &ipv4.ControlMessage{IfIndex: oob.IfIndex}
-			default:
-				l.log.Errorf("HandleMsg4: Did not receive interface information")
+	resp, ok = l.drops.runChain4(ctx, handlers, req, tmp)
+	if !ok {
+		return
+	}
+	if ctx.Err() != nil {
+		l.log.Printf("MainHandler4: dropping response to %s: %v", req.MessageType(), ctx.Err())
+		return
+	}
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		l.log.Debugf("MainHandler4: processed %s from %s", req.MessageType(), req.ClientHWAddr)
+		return
+	case dhcpv4.MessageTypeInform:
+		// The client already has an address, it only asked for
+		// configuration parameters (RFC2131 §4.3.5)
+		resp.YourIPAddr = net.IPv4zero
+		delete(resp.Options, dhcpv4.OptionIPAddressLeaseTime.Code())
+	}
+
+	if rai := req.Options.Get(dhcpv4.OptionRelayAgentInformation); rai != nil {
+		// Relays rely on getting the option back unchanged, whatever the
+		// plugins did (RFC3046 §2.2)
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, rai))
+	}
+	useEthernet := false
+	var peer *net.UDPAddr
+	if !req.GatewayIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: req.GatewayIPAddr, Port: relayPort4(req, src)}
+	} else if resp.MessageType() == dhcpv4.MessageTypeNak {
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	} else if !req.ClientIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
+	} else if req.IsBroadcast() || resp.YourIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	} else {
+		//sends a layer2 frame so that we can define the destination MAC address
+		peer = &net.UDPAddr{IP: resp.YourIPAddr, Port: dhcpv4.ClientPort}
+		useEthernet = true
+	}
+
+	var woob *ipv4.ControlMessage
+	if peer.IP.Equal(net.IPv4bcast) || peer.IP.IsLinkLocalUnicast() || useEthernet {
+		// Direct broadcasts, link-local and layer2 unicasts to the interface the request was
+		// received on. Other packets should use the normal routing table in
+		// case of asymetric routing
+		switch {
+		case l.Interface.Index != 0:
+			woob = &ipv4.ControlMessage{IfIndex: l.Interface.Index}
+		case oob != nil && oob.IfIndex != 0:
+			woob = &ipv4.ControlMessage{IfIndex: oob.IfIndex}
+		default:
+			l.log.Errorf("HandleMsg4: Did not receive interface information")
+			if useEthernet {
+				// Without the interface, the frame can't be sent
+				peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+				useEthernet = false
 			}
 		}
+	}
 
-		if useEthernet {
-			intf, err := net.InterfaceByIndex(woob.IfIndex)
-			if err != nil {
-				l.log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
-				return
-			}
-			err = sendEthernet(l.log, *intf, resp)
-			if err != nil {
-				l.log.Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
-			}
-		} else {
-			if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
-				l.log.Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
-			}
+	if useEthernet {
+		intf, err := net.InterfaceByIndex(woob.IfIndex)
+		if err != nil {
+			l.log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
+			return
+		}
+		err = sendEthernet(l.log, *intf, resp)
+		if err != nil {
+			l.log.Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
 		}
 	} else {
-		l.log.Print("MainHandler4: dropping request because response is nil")
+		if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
+			l.log.Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
+		}
 	}
 }
 
+// newContext returns the context to handle a request with, which is done after
+// timeout, or config.DefaultTimeout if zero
+func newContext(timeout time.Duration, log logrus.FieldLogger, ifIndex int, peer net.Addr) (*handler.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = config.DefaultTimeout
+	}
+	parent, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx := handler.NewContext(parent, log)
+	ctx.IfIndex = ifIndex
+	ctx.Peer, _ = peer.(*net.UDPAddr)
+	return ctx, cancel
+}
+
 // XXX: performance-wise, Pool may or may not be good (see https://github.com/golang/go/issues/23199)
 // Interface is good for what we want. Maybe "just" trust the GC and we'll be fine ?
 var bufpool = sync.Pool{New: func() interface{} { r := make([]byte, MaxDatagram); return &r }}
 
+// putBuffer gives a buffer back to bufpool. Buffers too small to receive any
+// datagram, like those of packets handled without a listener, are left out
+func putBuffer(buf []byte) {
+	if cap(buf) < MaxDatagram {
+		return
+	}
+	bufpool.Put(&buf)
+}
+
 // MaxDatagram is the maximum length of message that can be received.
 const MaxDatagram = 1 << 16
 
-// XXX: investigate using RecvMsgs to batch messages and reduce syscalls
-
 // Serve6 handles datagrams received on conn and passes them to the pluginchain
 func (l *listener6) Serve() error {
 	l.log.Printf("Listen %s", l.LocalAddr())
+	l.pool.start()
+	defer l.pool.stop()
+	if l.batch > 1 {
+		return l.serveBatch()
+	}
 	for {
 		b := *bufpool.Get().(*[]byte)
 		b = b[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
 
 		n, oob, peer, err := l.ReadFrom(b)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The server is shutting down
+				return nil
+			}
 			l.log.Printf("Error reading from connection: %v", err)
 			return err
 		}
-		go l.HandleMsg6(b[:n], oob, peer.(*net.UDPAddr))
+		udpPeer, ok := peer.(*net.UDPAddr)
+		if !ok {
+			l.log.Printf("Ignoring datagram from non-UDP address %v", peer)
+			putBuffer(b)
+			continue
+		}
+		c := l.chain.acquire()
+		l.pool.submit(job{c: c, buf: b, handle: func() {
+			l.HandleMsg6(c.Chain, b[:n], oob, udpPeer)
+		}})
 	}
 }
 
 // Serve6 handles datagrams received on conn and passes them to the pluginchain
 func (l *listener4) Serve() error {
 	l.log.Printf("Listen %s", l.LocalAddr())
+	l.pool.start()
+	defer l.pool.stop()
+	if l.batch > 1 {
+		return l.serveBatch()
+	}
 	for {
 		b := *bufpool.Get().(*[]byte)
 		b = b[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
 
 		n, oob, peer, err := l.ReadFrom(b)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The server is shutting down
+				return nil
+			}
+			l.log.Printf("Error reading from connection: %v", err)
+			return err
+		}
+		udpPeer, ok := peer.(*net.UDPAddr)
+		if !ok {
+			l.log.Printf("Ignoring datagram from non-UDP address %v", peer)
+			putBuffer(b)
+			continue
+		}
+		c := l.chain.acquire()
+		l.pool.submit(job{c: c, buf: b, handle: func() {
+			l.HandleMsg4(c.Chain, b[:n], oob, udpPeer)
+		}})
+	}
+}
+
+// serveBatch is like Serve, but reads up to l.batch datagrams per system call
+// where the platform supports it (recvmmsg on linux)
+func (l *listener6) serveBatch() error {
+	ms := make([]ipv6.Message, l.batch)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{nil}
+		ms[i].OOB = ipv6.NewControlMessage(ipv6.FlagInterface)
+	}
+	for {
+		// Buffers handed to the workers are replaced
+		for i := range ms {
+			if ms[i].Buffers[0] == nil {
+				b := *bufpool.Get().(*[]byte)
+				ms[i].Buffers[0] = b[:MaxDatagram]
+			}
+		}
+		n, err := l.ReadBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The server is shutting down
+				return nil
+			}
 			l.log.Printf("Error reading from connection: %v", err)
 			return err
 		}
-		go l.HandleMsg4(b[:n], oob, peer.(*net.UDPAddr))
+		for i := range ms[:n] {
+			m := &ms[i]
+			b, size := m.Buffers[0], m.N
+			peer, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				l.log.Printf("Ignoring datagram from non-UDP address %v", m.Addr)
+				continue
+			}
+			m.Buffers[0] = nil
+			var oob *ipv6.ControlMessage
+			if m.NN > 0 {
+				oob = new(ipv6.ControlMessage)
+				if err := oob.Parse(m.OOB[:m.NN]); err != nil {
+					l.log.Printf("Error parsing control message: %v", err)
+					oob = nil
+				} else {
+					oob.Src = peer.IP
+				}
+			}
+			c := l.chain.acquire()
+			l.pool.submit(job{c: c, buf: b, handle: func() {
+				l.HandleMsg6(c.Chain, b[:size], oob, peer)
+			}})
+		}
+	}
+}
+
+// serveBatch is like Serve, but reads up to l.batch datagrams per system call
+// where the platform supports it (recvmmsg on linux)
+func (l *listener4) serveBatch() error {
+	ms := make([]ipv4.Message, l.batch)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{nil}
+		ms[i].OOB = ipv4.NewControlMessage(ipv4.FlagInterface)
+	}
+	for {
+		// Buffers handed to the workers are replaced
+		for i := range ms {
+			if ms[i].Buffers[0] == nil {
+				b := *bufpool.Get().(*[]byte)
+				ms[i].Buffers[0] = b[:MaxDatagram]
+			}
+		}
+		n, err := l.ReadBatch(ms, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The server is shutting down
+				return nil
+			}
+			l.log.Printf("Error reading from connection: %v", err)
+			return err
+		}
+		for i := range ms[:n] {
+			m := &ms[i]
+			b, size := m.Buffers[0], m.N
+			peer, ok := m.Addr.(*net.UDPAddr)
+			if !ok {
+				l.log.Printf("Ignoring datagram from non-UDP address %v", m.Addr)
+				continue
+			}
+			m.Buffers[0] = nil
+			var oob *ipv4.ControlMessage
+			if m.NN > 0 {
+				oob = new(ipv4.ControlMessage)
+				if err := oob.Parse(m.OOB[:m.NN]); err != nil {
+					l.log.Printf("Error parsing control message: %v", err)
+					oob = nil
+				} else {
+					oob.Src = peer.IP
+				}
+			}
+			c := l.chain.acquire()
+			l.pool.submit(job{c: c, buf: b, handle: func() {
+				l.HandleMsg4(c.Chain, b[:size], oob, peer)
+			}})
+		}
 	}
 }
@@ -0,0 +1,420 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+// testListener4 returns a listener on the loopback handling requests with the
+// given handlers, named test0, test1, etc.
+func testListener4(t testing.TB, batch int, handlers ...handler.ContextHandler4) *listener4 {
+	l, err := listen4(testsLogger, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Could not listen on the loopback: %v", err)
+	}
+	named := make([]plugins.NamedHandler4, 0, len(handlers))
+	for i, h := range handlers {
+		named = append(named, plugins.NamedHandler4{Name: fmt.Sprintf("test%d", i), Handler: h})
+	}
+	l.chain = &activeChain{current: &chain{Chain: &plugins.Chain{Handlers4: named}}}
+	l.pool = newWorkerPool(config.WorkerConfig{}, testsLogger)
+	l.drops = &dropCounter{}
+	l.batch = batch
+	return l
+}
+
+func TestServeBatch(t *testing.T) {
+	handled := make(chan dhcpv4.TransactionID, 16)
+	l := testListener4(t, 8, handler.WithContext4(func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		handled <- req.TransactionID
+		return nil, true
+	}))
+	done := make(chan error)
+	go func() { done <- l.Serve() }()
+
+	conn, err := net.DialUDP("udp4", nil, l.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	sent := make(map[dhcpv4.TransactionID]bool)
+	for i := 0; i < 12; i++ {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, byte(i)})
+		require.NoError(t, err)
+		sent[req.TransactionID] = true
+		_, err = conn.Write(req.ToBytes())
+		require.NoError(t, err)
+	}
+	for range sent {
+		select {
+		case xid := <-handled:
+			assert.True(t, sent[xid], "Unexpected request %s", xid)
+			delete(sent, xid)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d requests were not handled", len(sent))
+		}
+	}
+
+	require.NoError(t, l.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestRelaySourcePort(t *testing.T) {
+	l := testListener4(t, 0, handler.WithContext4(func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		// Option 82 must be echoed whatever the plugins do
+		delete(resp.Options, dhcpv4.OptionRelayAgentInformation.Code())
+		return resp, false
+	}))
+	done := make(chan error)
+	go func() { done <- l.Serve() }()
+	defer func() {
+		require.NoError(t, l.Close())
+		assert.NoError(t, <-done)
+	}()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	relayed := func(subOptions ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subOptions...)))
+		require.NoError(t, err)
+		return req
+	}
+
+	// The relay asks for replies on its own port
+	req := relayed(
+		dhcpv4.OptGeneric(relaySourcePortSubOption, nil),
+		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0:10")),
+	)
+	_, err = relay.WriteTo(req.ToBytes(), l.LocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, relay.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, MaxDatagram)
+	n, err := relay.Read(buf)
+	require.NoError(t, err, "No reply on the relay source port")
+	resp, err := dhcpv4.FromBytes(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, req.TransactionID, resp.TransactionID)
+	if rai := resp.RelayAgentInfo(); assert.NotNil(t, rai) {
+		assert.True(t, rai.Has(relaySourcePortSubOption), "Source port sub-option was not echoed")
+		assert.Equal(t, []byte("eth0:10"), rai.Get(dhcpv4.AgentCircuitIDSubOption), "Circuit ID was not echoed")
+	}
+
+	src := relay.LocalAddr()
+	assert.Equal(t, src.(*net.UDPAddr).Port, relayPort4(req, src))
+	assert.Equal(t, dhcpv4.ServerPort, relayPort4(relayed(), src),
+		"Relays not asking for their source port must be replied to on the server port")
+}
+
+func TestRequestContext(t *testing.T) {
+	type seen struct {
+		peer  *net.UDPAddr
+		value interface{}
+	}
+	handled := make(chan seen, 1)
+	l := testListener4(t, 0,
+		func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			ctx.Set("test.value", req.ClientHWAddr.String())
+			return resp, handler.Continue
+		},
+		func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			value, _ := ctx.Get("test.value")
+			handled <- seen{peer: ctx.Peer, value: value}
+			if req.ClientHWAddr[5] == 0xff {
+				// Outlive the request
+				<-ctx.Done()
+			}
+			return resp, handler.Continue
+		},
+	)
+	l.timeout = 50 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- l.Serve() }()
+	defer func() {
+		require.NoError(t, l.Close())
+		assert.NoError(t, <-done)
+	}()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	exchange := func(mac net.HardwareAddr) error {
+		req, err := dhcpv4.NewDiscovery(mac,
+			dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(relaySourcePortSubOption, nil))))
+		require.NoError(t, err)
+		_, err = relay.WriteTo(req.ToBytes(), l.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = relay.Read(make([]byte, MaxDatagram))
+		return err
+	}
+
+	mac := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	assert.NoError(t, exchange(mac))
+	s := <-handled
+	assert.Equal(t, mac.String(), s.value, "Value not passed between handlers")
+	if assert.NotNil(t, s.peer) {
+		assert.Equal(t, relay.LocalAddr().String(), s.peer.String())
+	}
+
+	assert.Error(t, exchange(net.HardwareAddr{0, 1, 2, 3, 4, 0xff}), "Response to a timed out request was sent")
+	<-handled
+}
+
+func TestPluginDrops(t *testing.T) {
+	reached := make(chan byte, 4)
+	l := testListener4(t, 0,
+		func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			switch req.ClientHWAddr[5] {
+			case 1:
+				return resp, handler.Drop("blocked")
+			case 4:
+				panic("test")
+			}
+			return resp, handler.Continue
+		},
+		handler.WithContext4(func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			reached <- req.ClientHWAddr[5]
+			if req.ClientHWAddr[5] == 2 {
+				return nil, true
+			}
+			return resp, true
+		}),
+		func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			t.Error("The chain went on after a response")
+			return resp, handler.Continue
+		},
+	)
+	l.pool.workers = 1
+	done := make(chan error)
+	go func() { done <- l.Serve() }()
+	defer func() {
+		require.NoError(t, l.Close())
+		assert.NoError(t, <-done)
+	}()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	exchange := func(last byte) error {
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, last},
+			dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(relaySourcePortSubOption, nil))))
+		require.NoError(t, err)
+		_, err = relay.WriteTo(req.ToBytes(), l.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		_, err = relay.Read(make([]byte, MaxDatagram))
+		return err
+	}
+
+	assert.Error(t, exchange(1), "Response to a dropped request was sent")
+	assert.Error(t, exchange(2), "Response to a request without response was sent")
+	assert.NoError(t, exchange(3))
+	assert.Error(t, exchange(4), "Response to a request a plugin panicked on was sent")
+	assert.NoError(t, exchange(3), "Requests not handled after a panic")
+	require.Len(t, reached, 3, "The chain went on after a drop")
+	assert.Equal(t, []byte{2, 3, 3}, []byte{<-reached, <-reached, <-reached})
+	assert.Equal(t, map[string]map[string]uint64{
+		"test0": {"blocked": 1, reasonPanic: 1},
+		"test1": {handler.ReasonNoResponse: 1},
+	}, l.drops.snapshot())
+	assert.Equal(t, uint64(1), l.drops.panicCount())
+}
+
+func TestListenerPlugins(t *testing.T) {
+	used := make(chan string, 4)
+	record := func(name string) plugins.NamedHandler4 {
+		return plugins.NamedHandler4{Name: name, Handler: func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			used <- name
+			return resp, handler.Continue
+		}}
+	}
+	shared := testListener4(t, 0, record("server").Handler)
+	own := testListener4(t, 0)
+	own.chain = shared.chain
+	// Both were configured with port 0
+	own.addr = own.LocalAddr().String()
+	c := shared.chain.current
+	c.Handlers4[0].Name = "server"
+	c.Classes4 = []plugins.Class4{{
+		Name:     "all",
+		Match:    config.ClassMatch{HardwareType: uint16(iana.HWTypeEthernet)},
+		Handlers: []plugins.NamedHandler4{record("class")},
+	}}
+	c.Listeners4 = map[string][]plugins.NamedHandler4{own.addr: {record("listener")}}
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(relaySourcePortSubOption, nil))))
+	require.NoError(t, err)
+	for _, l := range []*listener4{shared, own} {
+		done := make(chan error)
+		go func(l *listener4) { done <- l.Serve() }(l)
+		_, err = relay.WriteTo(req.ToBytes(), l.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = relay.Read(make([]byte, MaxDatagram))
+		assert.NoError(t, err)
+		require.NoError(t, l.Close())
+		assert.NoError(t, <-done)
+	}
+
+	// The plugins of a listener replace all the others
+	require.Len(t, used, 3)
+	assert.Equal(t, []string{"server", "class", "listener"}, []string{<-used, <-used, <-used})
+}
+
+func TestServerPanic(t *testing.T) {
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	l := &listener4{log: testsLogger, drops: &dropCounter{}}
+	// Without a chain, handling the request panics outside of any plugin
+	assert.NotPanics(t, func() { l.HandleMsg4(nil, req.ToBytes(), nil, nil) })
+	assert.Equal(t, uint64(1), l.drops.panicCount())
+	assert.Empty(t, l.drops.snapshot())
+}
+
+// relayForward encapsulates msg in a Relay-Forward for each of the relay
+// source ports, from the innermost relay to the outermost. Relays with a port
+// of -1 don't include the Relay Source Port option
+func relayForward(t *testing.T, msg dhcpv6.DHCPv6, ports ...int) *dhcpv6.RelayMessage {
+	var relay *dhcpv6.RelayMessage
+	for _, port := range ports {
+		var err error
+		relay, err = dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+		require.NoError(t, err)
+		if port >= 0 {
+			relay.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRelayPort, OptionData: []byte{byte(port >> 8), byte(port)}})
+		}
+		msg = relay
+	}
+	return relay
+}
+
+// relayPorts returns the values of the Relay Source Port options of each
+// level of a relay message, from the outermost relay, -1 where there is none
+func relayPorts(t *testing.T, relay *dhcpv6.RelayMessage) []int {
+	var ports []int
+	for {
+		port := -1
+		if opt := relay.GetOneOption(dhcpv6.OptionRelayPort); opt != nil {
+			b := opt.ToBytes()
+			require.Len(t, b, 2)
+			port = int(b[0])<<8 | int(b[1])
+		}
+		ports = append(ports, port)
+		inner, ok := relay.Options.RelayMessage().(*dhcpv6.RelayMessage)
+		if !ok {
+			return ports
+		}
+		relay = inner
+	}
+}
+
+func TestEchoRelayPorts(t *testing.T) {
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	advertise, err := dhcpv6.NewAdvertiseFromSolicit(solicit)
+	require.NoError(t, err)
+	peer := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+
+	for _, ports := range [][]int{
+		{0},
+		{-1},
+		{4321, 0},
+		{-1, 4321, -1},
+		{1000, -1, 2000},
+	} {
+		forw := relayForward(t, solicit, ports...)
+		repl, err := dhcpv6.NewRelayReplFromRelayForw(forw, advertise)
+		require.NoError(t, err)
+		echoRelayPorts(forw, repl.(*dhcpv6.RelayMessage))
+		assert.Equal(t, relayPorts(t, forw), relayPorts(t, repl.(*dhcpv6.RelayMessage)), "Relay ports %v", ports)
+
+		expected := dhcpv6.DefaultServerPort
+		if ports[len(ports)-1] >= 0 {
+			expected = peer.Port
+		}
+		assert.Equal(t, expected, relayPort6(forw, peer), "Relay ports %v", ports)
+	}
+}
+
+// benchmarkRead4 measures reading datagrams from a listener, one at a time if
+// batch is 0, or batch at a time
+func benchmarkRead4(b *testing.B, batch int) {
+	l := testListener4(b, 0)
+	defer l.Close()
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(b, err)
+
+	// Keep the socket fed, as datagrams overflowing its buffer are lost
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 4; i++ {
+		conn, err := net.DialUDP("udp4", nil, l.LocalAddr().(*net.UDPAddr))
+		require.NoError(b, err)
+		defer conn.Close()
+		go func() {
+			pc := ipv4.NewPacketConn(conn)
+			out := make([]ipv4.Message, 64)
+			for i := range out {
+				out[i].Buffers = [][]byte{req.ToBytes()}
+			}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					pc.WriteBatch(out, 0)
+				}
+			}
+		}()
+	}
+
+	ms := make([]ipv4.Message, batch)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, MaxDatagram)}
+		ms[i].OOB = ipv4.NewControlMessage(ipv4.FlagInterface)
+	}
+	buf := make([]byte, MaxDatagram)
+	b.ResetTimer()
+	for read := 0; read < b.N; {
+		if batch == 0 {
+			if _, _, _, err := l.ReadFrom(buf); err != nil {
+				b.Fatal(err)
+			}
+			read++
+			continue
+		}
+		n, err := l.ReadBatch(ms, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		read += n
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B)    { benchmarkRead4(b, 0) }
+func BenchmarkReadBatch8(b *testing.B)  { benchmarkRead4(b, 8) }
+func BenchmarkReadBatch32(b *testing.B) { benchmarkRead4(b, 32) }
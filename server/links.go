@@ -0,0 +1,165 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insei/coredhcp/plugins/relayinfo"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// linkAddrs4 returns addresses on the link a client is on, to select its
+// subnet with. In order of preference, that's the link selection sub-option
+// of relayed requests (RFC 3527), the relay address, or else the addresses of
+// the interface the request was received on for directly connected clients
+func (l *listener4) linkAddrs4(req *dhcpv4.DHCPv4, oob *ipv4.ControlMessage) []net.IP {
+	if !req.GatewayIPAddr.IsUnspecified() {
+		// Only relays are trusted to select the link
+		if info := relayinfo.FromRequest(req); info != nil && info.LinkSelection != nil {
+			return []net.IP{info.LinkSelection}
+		}
+		return []net.IP{req.GatewayIPAddr}
+	}
+
+	index := l.Interface.Index
+	if index == 0 && oob != nil {
+		index = oob.IfIndex
+	}
+	if index == 0 {
+		return nil
+	}
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		l.log.Errorf("MainHandler4: Can not get Interface for index %d %v", index, err)
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		l.log.Errorf("MainHandler4: Can not get the addresses of %s: %v", ifi.Name, err)
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// handlers4 returns the handlers to run for a request. If subnets are
+// configured, those are the handlers of the first subnet the client is on,
+// and false is returned if it's on none of them. Clients sending from their
+// address (ciaddr) must be on a subnet of the interface the request arrived on
+func (l *listener4) handlers4(chain *plugins.Chain, req *dhcpv4.DHCPv4, oob *ipv4.ControlMessage) ([]plugins.NamedHandler4, bool) {
+	if len(chain.Subnets4) == 0 {
+		return chain.Handlers4, true
+	}
+	addrs := l.linkAddrs4(req, oob)
+	if req.GatewayIPAddr.IsUnspecified() && !req.ClientIPAddr.IsUnspecified() {
+		// Renewing and releasing clients unicast from their address, which
+		// selects their subnet among those of the interface the request
+		// arrived on. Any other subnet would hand out or free addresses of
+		// the wrong pool, and a client can't select one off the link
+		for _, subnet := range chain.Subnets4 {
+			if subnet.Net.Contains(req.ClientIPAddr) && onLink(subnet.Net, addrs) {
+				return subnet.Handlers, true
+			}
+		}
+		l.log.Printf("MainHandler4: no subnet for %s from %s on link %v, dropping it", req.MessageType(), req.ClientIPAddr, addrs)
+		return nil, false
+	}
+	for _, subnet := range chain.Subnets4 {
+		if onLink(subnet.Net, addrs) {
+			return subnet.Handlers, true
+		}
+	}
+	l.log.Printf("MainHandler4: no subnet for %s from link %v, dropping it", req.MessageType(), addrs)
+	return nil, false
+}
+
+// onLink tells whether one of the addresses of a link is in subnet
+func onLink(subnet net.IPNet, addrs []net.IP) bool {
+	for _, addr := range addrs {
+		if subnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayLink6 returns what identifies the link a client is on: the link-address
+// and interface-id of the relay closest to the client for relayed requests,
+// or else the addresses of the interface the request was received on
+func (l *listener6) relayLink6(d dhcpv6.DHCPv6, oob *ipv6.ControlMessage) ([]net.IP, []byte) {
+	if d.IsRelay() {
+		relay := innermostRelay(d)
+		if relay == nil {
+			return nil, nil
+		}
+		if relay.LinkAddr == nil || relay.LinkAddr.IsUnspecified() {
+			// The relay has no address on the link, the interface-id alone
+			// identifies it
+			return nil, relay.Options.InterfaceID()
+		}
+		return []net.IP{relay.LinkAddr}, relay.Options.InterfaceID()
+	}
+
+	index := l.Interface.Index
+	if index == 0 && oob != nil {
+		index = oob.IfIndex
+	}
+	if index == 0 {
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		l.log.Errorf("MainHandler6: Can not get Interface for index %d %v", index, err)
+		return nil, nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		l.log.Errorf("MainHandler6: Can not get the addresses of %s: %v", ifi.Name, err)
+		return nil, nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// handlers6 returns the handlers to run for a request. If links are
+// configured, those are the handlers of the first link matching either the
+// interface-id or an address of the client's link, and false is returned if
+// none matches
+func (l *listener6) handlers6(chain *plugins.Chain, d dhcpv6.DHCPv6, oob *ipv6.ControlMessage) ([]plugins.NamedHandler6, bool) {
+	if len(chain.Links6) == 0 {
+		return chain.Handlers6, true
+	}
+	addrs, interfaceID := l.relayLink6(d, oob)
+	for _, link := range chain.Links6 {
+		if link.InterfaceID != "" && interfaceID != nil && link.InterfaceID == string(interfaceID) {
+			return link.Handlers, true
+		}
+		if link.Net.IP == nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if link.Net.Contains(addr) {
+				return link.Handlers, true
+			}
+		}
+	}
+	l.log.Printf("MainHandler6: no link for %s from link %v (interface-id %q), dropping it", d.Type(), addrs, interfaceID)
+	return nil, false
+}
@@ -0,0 +1,151 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnetSelection(t *testing.T) {
+	var selected string
+	subnet := func(cidr string) plugins.Subnet4 {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		return plugins.Subnet4{Net: *ipnet, Handlers: []plugins.NamedHandler4{{
+			Name: cidr,
+			Handler: func(_ *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+				selected = cidr
+				return resp, handler.Continue
+			},
+		}}}
+	}
+	chain := &plugins.Chain{Subnets4: []plugins.Subnet4{
+		subnet("192.0.2.0/25"),
+		subnet("192.0.2.128/25"),
+		// Two subnets on the loopback, for renewals to pick from
+		subnet("127.0.0.0/30"),
+		subnet("127.0.0.0/8"),
+	}}
+	l := &listener4{log: testsLogger}
+	lo, err := net.InterfaceByName("lo")
+	if err == nil {
+		l.Interface = *lo
+	}
+
+	for _, tt := range []struct {
+		name     string
+		mods     []dhcpv4.Modifier
+		expected string
+	}{
+		{"relay", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 129))}, "192.0.2.128/25"},
+		{"link selection", []dhcpv4.Modifier{
+			dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 129)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, []byte{192, 0, 2, 1}))),
+		}, "192.0.2.0/25"},
+		{"relayed renewal", []dhcpv4.Modifier{
+			dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 129)),
+			dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10)),
+		}, "192.0.2.128/25"},
+		{"unknown relay", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))}, ""},
+		{"direct", nil, "127.0.0.0/30"},
+		{"renewal", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(127, 0, 0, 10))}, "127.0.0.0/8"},
+		// A renewal from another link neither selects its subnet nor gets
+		// an address of the interface's one
+		{"renewal from another subnet", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 10))}, ""},
+		{"renewal from an unknown subnet", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(198, 51, 100, 10))}, ""},
+	} {
+		if strings.HasPrefix(tt.expected, "127.") && l.Interface.Index == 0 {
+			t.Logf("No loopback interface, skipping directly connected client: %s", tt.name)
+			continue
+		}
+		req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5}, tt.mods...)
+		require.NoError(t, err)
+		selected = ""
+		handlers, ok := l.handlers4(chain, req, nil)
+		assert.Equal(t, tt.expected != "", ok, tt.name)
+		for _, h := range handlers {
+			h.Handler(nil, req, nil)
+		}
+		assert.Equal(t, tt.expected, selected, tt.name)
+	}
+
+	// Without subnets, all requests are handled by the server-wide plugins
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5}, dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1)))
+	require.NoError(t, err)
+	_, ok := l.handlers4(&plugins.Chain{}, req, nil)
+	assert.True(t, ok)
+}
+
+func TestLinkSelection(t *testing.T) {
+	var selected string
+	link := func(name, prefix, interfaceID string) plugins.Link6 {
+		l := plugins.Link6{InterfaceID: interfaceID, Handlers: []plugins.NamedHandler6{{
+			Name: name,
+			Handler: func(_ *handler.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, handler.Result) {
+				selected = name
+				return resp, handler.Continue
+			},
+		}}}
+		if prefix != "" {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			require.NoError(t, err)
+			l.Net = *ipnet
+		}
+		return l
+	}
+	chain := &plugins.Chain{Links6: []plugins.Link6{
+		link("first", "2001:db8:1::/64", ""),
+		link("second", "2001:db8:2::/64", "eth0.2"),
+		link("third", "", "eth0.3"),
+	}}
+	l := &listener6{log: testsLogger}
+
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	// relayed encapsulates the solicit in relays, from the closest to the
+	// client to the farthest, given as link-address and interface-id pairs
+	relayed := func(relays ...string) dhcpv6.DHCPv6 {
+		var msg dhcpv6.DHCPv6 = solicit
+		for i := 0; i < len(relays); i += 2 {
+			relay, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, net.ParseIP(relays[i]), net.ParseIP("fe80::1"))
+			require.NoError(t, err)
+			if relays[i+1] != "" {
+				relay.AddOption(dhcpv6.OptInterfaceID([]byte(relays[i+1])))
+			}
+			msg = relay
+		}
+		return msg
+	}
+
+	for _, tt := range []struct {
+		name     string
+		msg      dhcpv6.DHCPv6
+		expected string
+	}{
+		{"link-address", relayed("2001:db8:2::1", ""), "second"},
+		{"nested relays", relayed("2001:db8:1::1", "", "2001:db8:2::1", "eth0.2"), "first"},
+		{"interface-id", relayed("::", "eth0.3"), "third"},
+		{"interface-id with unknown link-address", relayed("2001:db8:9::1", "eth0.2"), "second"},
+		{"unknown link", relayed("2001:db8:9::1", "eth0.9"), ""},
+		{"direct without interface", solicit, ""},
+	} {
+		selected = ""
+		handlers, ok := l.handlers6(chain, tt.msg, nil)
+		assert.Equal(t, tt.expected != "", ok, tt.name)
+		for _, h := range handlers {
+			h.Handler(nil, tt.msg, nil)
+		}
+		assert.Equal(t, tt.expected, selected, tt.name)
+	}
+}
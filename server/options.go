@@ -0,0 +1,255 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins"
+)
+
+// Option configures a server created with New
+type Option func(*options) error
+
+// options are the settings of New, gathered into the configuration and the
+// plugin registry of the server
+type options struct {
+	conf     config.Config
+	registry *plugins.Registry
+	conns    map[string]net.PacketConn
+	log      logrus.FieldLogger
+}
+
+// server4 returns the DHCPv4 configuration, creating it if needed
+func (o *options) server4() *config.ServerConfig {
+	if o.conf.Server4 == nil {
+		o.conf.Server4 = &config.ServerConfig{}
+	}
+	return o.conf.Server4
+}
+
+// server6 returns the DHCPv6 configuration, creating it if needed
+func (o *options) server6() *config.ServerConfig {
+	if o.conf.Server6 == nil {
+		o.conf.Server6 = &config.ServerConfig{}
+	}
+	return o.conf.Server6
+}
+
+// addPlugin registers a plugin for the server, unless it already is, and
+// appends it with args to the plugins of sc
+func (o *options) addPlugin(sc *config.ServerConfig, plugin *plugins.Plugin, args []string) error {
+	if plugin == nil {
+		return errors.New("cannot use nil plugin")
+	}
+	if o.registry.Get(plugin.Name) != plugin {
+		if err := o.registry.Register(plugin); err != nil {
+			return err
+		}
+	}
+	sc.Plugins = append(sc.Plugins, config.PluginConfig{Name: plugin.Name, Args: args})
+	return nil
+}
+
+// addConn records a connection to listen on, it returns its address. The
+// connection is closed if it can't be used
+func (o *options) addConn(ver int, conn net.PacketConn) (*net.UDPAddr, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("DHCPv%d: cannot use nil connection", ver)
+	}
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("DHCPv%d: connection on %v is not bound to a UDP address", ver, conn.LocalAddr())
+	}
+	key := listenKey(ver, addr)
+	if prev, ok := o.conns[key]; ok {
+		if prev != conn {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("DHCPv%d: connection on %s given twice", ver, addr)
+	}
+	o.conns[key] = conn
+	return addr, nil
+}
+
+// WithName sets the name of the server, which prefixes its logs. It is
+// "server" by default
+func WithName(name string) Option {
+	return func(o *options) error {
+		o.conf.Name = name
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the server and its plugins
+func WithLogger(log logrus.FieldLogger) Option {
+	return func(o *options) error {
+		o.log = log
+		return nil
+	}
+}
+
+// WithListen4 makes the DHCPv4 server listen on addrs
+func WithListen4(addrs ...*net.UDPAddr) Option {
+	return func(o *options) error {
+		sc := o.server4()
+		for _, addr := range addrs {
+			sc.Addresses = append(sc.Addresses, *addr)
+		}
+		return nil
+	}
+}
+
+// WithListen6 makes the DHCPv6 server listen on addrs
+func WithListen6(addrs ...*net.UDPAddr) Option {
+	return func(o *options) error {
+		sc := o.server6()
+		for _, addr := range addrs {
+			sc.Addresses = append(sc.Addresses, *addr)
+		}
+		return nil
+	}
+}
+
+// WithConn4 makes the DHCPv4 server receive requests on a connection opened
+// by the caller, like a socket inherited from a service manager or bound to a
+// loopback port in tests. Its local address must be a *net.UDPAddr. Other
+// connections than *net.UDPConn, like in-memory ones, have no control
+// messages: the interface of requests is unknown unless the address has a
+// zone, and the caller joins multicast groups. The server owns the
+// connection: it closes it when it stops, or when New fails
+func WithConn4(conn net.PacketConn) Option {
+	return func(o *options) error {
+		addr, err := o.addConn(4, conn)
+		if err != nil {
+			return err
+		}
+		sc := o.server4()
+		sc.Addresses = append(sc.Addresses, *addr)
+		return nil
+	}
+}
+
+// WithConn6 is like WithConn4, for the DHCPv6 server
+func WithConn6(conn net.PacketConn) Option {
+	return func(o *options) error {
+		addr, err := o.addConn(6, conn)
+		if err != nil {
+			return err
+		}
+		sc := o.server6()
+		sc.Addresses = append(sc.Addresses, *addr)
+		return nil
+	}
+}
+
+// WithPlugin4 appends a plugin, set up with args, to the DHCPv4 handler chain.
+// The plugin doesn't need to be registered, but the names of the plugins of a
+// server must be unique
+func WithPlugin4(plugin *plugins.Plugin, args ...string) Option {
+	return func(o *options) error {
+		return o.addPlugin(o.server4(), plugin, args)
+	}
+}
+
+// WithPlugin6 is like WithPlugin4, for the DHCPv6 handler chain
+func WithPlugin6(plugin *plugins.Plugin, args ...string) Option {
+	return func(o *options) error {
+		return o.addPlugin(o.server6(), plugin, args)
+	}
+}
+
+// WithHandler4 appends a handler to the DHCPv4 handler chain, as if it were
+// the plugin called name
+func WithHandler4(name string, h handler.Handler4) Option {
+	return WithPlugin4(&plugins.Plugin{
+		Name:   name,
+		Setup4: func(logrus.FieldLogger, ...string) (handler.Handler4, error) { return h, nil },
+	})
+}
+
+// WithHandler6 is like WithHandler4, for the DHCPv6 handler chain
+func WithHandler6(name string, h handler.Handler6) Option {
+	return WithPlugin6(&plugins.Plugin{
+		Name:   name,
+		Setup6: func(logrus.FieldLogger, ...string) (handler.Handler6, error) { return h, nil },
+	})
+}
+
+// WithContextHandler4 is like WithHandler4, for a handler receiving the
+// context of each request
+func WithContextHandler4(name string, h handler.ContextHandler4) Option {
+	return WithPlugin4(&plugins.Plugin{
+		Name: name,
+		InitContext4: func(logrus.FieldLogger, ...string) (handler.ContextHandler4, io.Closer, error) {
+			return h, nil, nil
+		},
+	})
+}
+
+// WithContextHandler6 is like WithContextHandler4, for the DHCPv6 handler
+// chain
+func WithContextHandler6(name string, h handler.ContextHandler6) Option {
+	return WithPlugin6(&plugins.Plugin{
+		Name: name,
+		InitContext6: func(logrus.FieldLogger, ...string) (handler.ContextHandler6, io.Closer, error) {
+			return h, nil, nil
+		},
+	})
+}
+
+// New starts a server configured by options rather than a configuration file,
+// for programs embedding it. Like Start, it returns once the server is
+// listening; use Shutdown or Close to stop it. At least a listen address or
+// a connection is needed for each protocol the server handles. Reload only
+// knows the plugins given to New
+func New(opts ...Option) (*Servers, error) {
+	o := options{
+		conf:     config.Config{Name: "server"},
+		registry: plugins.NewRegistry(),
+		conns:    make(map[string]net.PacketConn),
+		log:      logger.GetLogger("server"),
+	}
+	srv, err := o.start(opts)
+	if err != nil {
+		// Close the connections no listener took over
+		for _, conn := range o.conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return srv, nil
+}
+
+// start applies opts and starts the server
+func (o *options) start(opts []Option) (*Servers, error) {
+	// Apply all the options even after an error, so that New gets all the
+	// connections to close
+	var err error
+	for _, opt := range opts {
+		if optErr := opt(o); optErr != nil && err == nil {
+			err = optErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.conf.Server4 != nil && len(o.conf.Server4.Addresses) == 0 {
+		return nil, errors.New("DHCPv4: no listen address nor connection")
+	}
+	if o.conf.Server6 != nil && len(o.conf.Server6.Addresses) == 0 {
+		return nil, errors.New("DHCPv6: no listen address nor connection")
+	}
+	return start(o.log, &o.conf, o.registry, o.conns)
+}
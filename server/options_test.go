@@ -0,0 +1,186 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	conn4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Could not listen on the loopback: %v", err)
+	}
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		conn4.Close()
+		t.Skipf("Could not listen on the IPv6 loopback: %v", err)
+	}
+	srv, err := New(
+		WithName("embedded"),
+		WithLogger(testsLogger),
+		WithConn4(conn4),
+		WithConn6(conn6),
+		WithHandler4("test_hostname", func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			resp.ServerHostName = "embedded"
+			return resp, false
+		}),
+		WithContextHandler4("test_drop", func(ctx *handler.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, handler.Result) {
+			if req.ClientHWAddr[5] == 0xff {
+				return nil, handler.Drop("unwanted")
+			}
+			return resp, handler.Respond
+		}),
+		WithHandler6("test_dns", func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+			resp.AddOption(dhcpv6.OptDNS(net.ParseIP("2001:db8::53")))
+			return resp, true
+		}),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, srv.Shutdown(context.Background()))
+		assert.NoError(t, srv.Wait())
+	}()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	exchange4 := func(mac net.HardwareAddr) (*dhcpv4.DHCPv4, error) {
+		req, err := dhcpv4.NewDiscovery(mac,
+			dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(relaySourcePortSubOption, nil))))
+		require.NoError(t, err)
+		_, err = relay.WriteTo(req.ToBytes(), conn4.LocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, MaxDatagram)
+		n, err := relay.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return dhcpv4.FromBytes(buf[:n])
+	}
+	resp4, err := exchange4(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	assert.Equal(t, "embedded", resp4.ServerHostName)
+	_, err = exchange4(net.HardwareAddr{0, 1, 2, 3, 4, 0xff})
+	assert.Error(t, err, "Dropped request was answered")
+	assert.Equal(t, map[string]map[string]uint64{"test_drop": {"unwanted": 1}}, srv.PluginDrops())
+
+	client, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	require.NoError(t, err)
+	defer client.Close()
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	_, err = client.WriteTo(solicit.ToBytes(), conn6.LocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, MaxDatagram)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	resp6, err := dhcpv6.FromBytes(buf[:n])
+	require.NoError(t, err)
+	assert.NotNil(t, resp6.GetOneOption(dhcpv6.OptionDNSRecursiveNameServer), "DHCPv6 handler not called")
+}
+
+// packetConn hides the type of a connection, like connections that aren't
+// sockets
+type packetConn struct {
+	net.PacketConn
+	localAddr net.Addr
+}
+
+func (c packetConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.PacketConn.LocalAddr()
+}
+
+func TestNewPacketConn(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Could not listen on the loopback: %v", err)
+	}
+	srv, err := New(
+		WithLogger(testsLogger),
+		WithConn4(packetConn{PacketConn: conn}),
+		WithHandler4("test_hostname", func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			resp.ServerHostName = "plain"
+			return resp, false
+		}),
+	)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, srv.Shutdown(context.Background()))
+		assert.NoError(t, srv.Wait())
+	}()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer relay.Close()
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		dhcpv4.WithGatewayIP(net.IPv4(127, 0, 0, 1)),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(relaySourcePortSubOption, nil))))
+	require.NoError(t, err)
+	_, err = relay.WriteTo(req.ToBytes(), conn.LocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, MaxDatagram)
+	n, err := relay.Read(buf)
+	require.NoError(t, err)
+	resp, err := dhcpv4.FromBytes(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, "plain", resp.ServerHostName)
+}
+
+func TestNewErrors(t *testing.T) {
+	h4 := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	_, err := New()
+	assert.Error(t, err, "Server without a protocol")
+	_, err = New(WithHandler4("test", h4))
+	assert.Error(t, err, "Server without listeners")
+	_, err = New(WithListen4(loopback), WithHandler4("test", h4), WithHandler4("test", h4))
+	assert.Error(t, err, "Handlers with the same name")
+
+	// Connections are closed when New fails
+	conn, err := net.ListenUDP("udp4", loopback)
+	require.NoError(t, err)
+	_, err = New(WithConn4(conn), WithPlugin4(nil))
+	assert.Error(t, err)
+	assert.Error(t, conn.Close(), "Connection left open")
+
+	// Including those given after the failing option, or given twice
+	conn, err = net.ListenUDP("udp4", loopback)
+	require.NoError(t, err)
+	other, err := net.ListenUDP("udp4", conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		// The port can only be bound once, give the same connection twice
+		other = conn
+	}
+	_, err = New(WithPlugin4(nil), WithConn4(conn), WithConn4(other))
+	assert.Error(t, err)
+	assert.Error(t, conn.Close(), "Connection left open")
+	assert.Error(t, other.Close(), "Duplicate connection left open")
+	_, err = New(WithConn4(nil))
+	assert.Error(t, err, "Nil connection accepted")
+
+	conn, err = net.ListenUDP("udp4", loopback)
+	require.NoError(t, err)
+	_, err = New(WithConn4(packetConn{PacketConn: conn, localAddr: &net.IPAddr{IP: loopback.IP}}))
+	assert.Error(t, err, "Connection without a UDP address accepted")
+	assert.Error(t, conn.Close(), "Connection left open")
+}
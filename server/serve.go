@@ -5,54 +5,146 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
 	"github.com/insei/coredhcp/config"
-	"github.com/insei/coredhcp/handler"
 	"github.com/insei/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/insomniacslk/dhcp/dhcpv6/server6"
 )
 
 type listener6 struct {
-	*ipv6.PacketConn
+	conn6
 	net.Interface
-	handlers []handler.Handler6
-	log      logrus.FieldLogger
+	// addr is the configured address of the listener, as formatted by
+	// net.UDPAddr.String
+	addr  string
+	chain *activeChain
+	pool  *workerPool
+	// batch is the number of datagrams read at once, batching is disabled if
+	// it is 1 or less
+	batch int
+	// timeout is the time limit to handle a request, see config.DefaultTimeout
+	timeout time.Duration
+	// drops counts the requests dropped by plugins, it is shared by the
+	// listeners of a server
+	drops *dropCounter
+	log   logrus.FieldLogger
 }
 
 type listener4 struct {
-	*ipv4.PacketConn
+	conn4
 	net.Interface
-	handlers []handler.Handler4
-	log      logrus.FieldLogger
+	// addr is the configured address of the listener, as formatted by
+	// net.UDPAddr.String
+	addr  string
+	chain *activeChain
+	pool  *workerPool
+	// batch is the number of datagrams read at once, batching is disabled if
+	// it is 1 or less
+	batch int
+	// timeout is the time limit to handle a request, see config.DefaultTimeout
+	timeout time.Duration
+	// drops counts the requests dropped by plugins, it is shared by the
+	// listeners of a server
+	drops *dropCounter
+	log   logrus.FieldLogger
 }
 
 type listener interface {
 	io.Closer
+	Serve() error
+	droppedCount() uint64
 }
 
 // Servers contains state for a running server (with possibly multiple interfaces/listeners)
 type Servers struct {
-	listeners []listener
+	// mu protects listeners
+	mu sync.Mutex
+	// listeners are keyed by listenKey
+	listeners map[string]listener
 	errors    chan error
-	Log       logrus.FieldLogger
+	done      chan struct{}
+	closeOnce sync.Once
+	chain     activeChain
+	// reloadLock serializes reloads, which reuse the current plugins
+	reloadLock sync.Mutex
+	// retiring tracks the chains replaced by a reload until they're closed
+	retiring sync.WaitGroup
+	// serving tracks the listeners until they stop serving, which they do
+	// once the requests they received are handled
+	serving sync.WaitGroup
+	drops   dropCounter
+	// conns are the connections given to New, keyed by listenKey, until
+	// listeners use them
+	conns map[string]net.PacketConn
+	// registry holds the plugins the configuration refers to
+	registry *plugins.Registry
+	Log      logrus.FieldLogger
+}
+
+func (l *listener4) droppedCount() uint64 { return l.pool.droppedCount() }
+
+func (l *listener6) droppedCount() uint64 { return l.pool.droppedCount() }
+
+// Dropped returns the number of datagrams each listener dropped because its
+// queue was full, keyed by protocol version and address, e.g. "v4 0.0.0.0:67"
+func (s *Servers) Dropped() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := make(map[string]uint64, len(s.listeners))
+	for key, l := range s.listeners {
+		dropped[key] = l.droppedCount()
+	}
+	return dropped
+}
+
+// PluginDrops returns the number of requests each plugin dropped, keyed by
+// plugin name and reason
+func (s *Servers) PluginDrops() map[string]map[string]uint64 {
+	return s.drops.snapshot()
+}
+
+// Panics returns the number of panics recovered from while handling requests.
+// The requests are dropped, and those a plugin panicked on are also counted
+// in PluginDrops with the reason "panic"
+func (s *Servers) Panics() uint64 {
+	return s.drops.panicCount()
+}
+
+// listenKey identifies the listener of an address
+func listenKey(ver int, addr *net.UDPAddr) string {
+	return fmt.Sprintf("v%d %s", ver, addr)
 }
 
 func listen4(logger logrus.FieldLogger, a *net.UDPAddr) (*listener4, error) {
-	var err error
-	l4 := listener4{log: logger}
 	udpConn, err := server4.NewIPv4UDPConn(a.Zone, a)
 	if err != nil {
 		return nil, err
 	}
-	l4.PacketConn = ipv4.NewPacketConn(udpConn)
+	return newListener4(logger, udpConn, a)
+}
+
+// newListener4 returns a listener receiving on a connection bound to a. The
+// connection is closed if that fails. Only UDP sockets can join multicast
+// groups and, where the platform supports it, provide the control messages
+// telling the interface of each request; the listener works without them
+func newListener4(logger logrus.FieldLogger, conn net.PacketConn, a *net.UDPAddr) (_ *listener4, err error) {
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	l4 := listener4{addr: a.String(), log: logger}
 	var ifi *net.Interface
 	if a.Zone != "" {
 		ifi, err = net.InterfaceByName(a.Zone)
@@ -60,18 +152,30 @@ func listen4(logger logrus.FieldLogger, a *net.UDPAddr) (*listener4, error) {
 			return nil, fmt.Errorf("DHCPv4: Listen could not find interface %s: %v", a.Zone, err)
 		}
 		l4.Interface = *ifi
-	} else {
-
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		if a.Zone == "" {
+			logger.Warningf("DHCPv4: %T on %s has no control messages, the interface of requests is unknown", conn, a)
+		}
+		if a.IP.IsMulticast() {
+			logger.Warningf("DHCPv4: not joining %s on %T, it must be done by the caller", a.IP, conn)
+		}
+		l4.conn4 = plainConn4{conn}
+		return &l4, nil
+	}
+	pc := ipv4.NewPacketConn(udpConn)
+	l4.conn4 = pc
+	if a.Zone == "" {
 		// When not bound to an interface, we need the information in each
 		// packet to know which interface it came on
-		err = l4.SetControlMessage(ipv4.FlagInterface, true)
-		if err != nil {
-			return nil, err
+		if err := pc.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			logger.Warningf("DHCPv4: no control messages on %s, the interface of requests is unknown: %v", a, err)
 		}
 	}
 
 	if a.IP.IsMulticast() {
-		err = l4.JoinGroup(ifi, a)
+		err = pc.JoinGroup(ifi, a)
 		if err != nil {
 			return nil, err
 		}
@@ -80,12 +184,21 @@ func listen4(logger logrus.FieldLogger, a *net.UDPAddr) (*listener4, error) {
 }
 
 func listen6(logger logrus.FieldLogger, a *net.UDPAddr) (*listener6, error) {
-	l6 := listener6{log: logger}
 	udpconn, err := server6.NewIPv6UDPConn(a.Zone, a)
 	if err != nil {
 		return nil, err
 	}
-	l6.PacketConn = ipv6.NewPacketConn(udpconn)
+	return newListener6(logger, udpconn, a)
+}
+
+// newListener6 is like newListener4, for DHCPv6
+func newListener6(logger logrus.FieldLogger, conn net.PacketConn, a *net.UDPAddr) (_ *listener6, err error) {
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	l6 := listener6{addr: a.String(), log: logger}
 	var ifi *net.Interface
 	if a.Zone != "" {
 		ifi, err = net.InterfaceByName(a.Zone)
@@ -93,17 +206,30 @@ func listen6(logger logrus.FieldLogger, a *net.UDPAddr) (*listener6, error) {
 			return nil, fmt.Errorf("DHCPv4: Listen could not find interface %s: %v", a.Zone, err)
 		}
 		l6.Interface = *ifi
-	} else {
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		if a.Zone == "" {
+			logger.Warningf("DHCPv6: %T on %s has no control messages, the interface of requests is unknown", conn, a)
+		}
+		if a.IP.IsMulticast() {
+			logger.Warningf("DHCPv6: not joining %s on %T, it must be done by the caller", a.IP, conn)
+		}
+		l6.conn6 = plainConn6{conn}
+		return &l6, nil
+	}
+	pc := ipv6.NewPacketConn(udpConn)
+	l6.conn6 = pc
+	if a.Zone == "" {
 		// When not bound to an interface, we need the information in each
 		// packet to know which interface it came on
-		err = l6.SetControlMessage(ipv6.FlagInterface, true)
-		if err != nil {
-			return nil, err
+		if err := pc.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+			logger.Warningf("DHCPv6: no control messages on %s, the interface of requests is unknown: %v", a, err)
 		}
 	}
 
 	if a.IP.IsMulticast() {
-		err = l6.JoinGroup(ifi, a)
+		err = pc.JoinGroup(ifi, a)
 		if err != nil {
 			return nil, err
 		}
@@ -112,71 +238,240 @@ func listen6(logger logrus.FieldLogger, a *net.UDPAddr) (*listener6, error) {
 }
 
 // Start will start the server asynchronously. See `Wait` to wait until
-// the execution ends.
+// the execution ends. The plugins are those of plugins.DefaultRegistry.
 func Start(logger logrus.FieldLogger, config *config.Config) (*Servers, error) {
+	return StartWithRegistry(logger, config, plugins.DefaultRegistry)
+}
+
+// StartWithRegistry is like Start, with the plugins of a registry. They are
+// also used when the server is reloaded
+func StartWithRegistry(logger logrus.FieldLogger, config *config.Config, registry *plugins.Registry) (*Servers, error) {
+	return start(logger, config, registry, nil)
+}
+
+// start starts a server, listening on conns rather than opening connections
+// for their addresses
+func start(logger logrus.FieldLogger, config *config.Config, registry *plugins.Registry, conns map[string]net.PacketConn) (*Servers, error) {
 	serverLogger := logger.WithField("prefix", config.Name)
-	handlers4, handlers6, err := plugins.LoadPlugins(serverLogger, config)
+	pluginChain, err := registry.Load(serverLogger, config)
 	if err != nil {
 		return nil, err
 	}
-	srv := Servers{
-		errors: make(chan error),
-		Log:    serverLogger,
+	srv := &Servers{
+		listeners: make(map[string]listener),
+		// A single error is enough for Wait to return
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+		conns:    conns,
+		registry: registry,
+		Log:      serverLogger,
+	}
+	srv.chain.current = &chain{Chain: pluginChain}
+
+	if _, err := srv.updateListeners(config); err != nil {
+		srv.Close()
+		pluginChain.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// updateListeners starts listening on the addresses of the configuration that
+// aren't listened on yet. If that fails, the new listeners are closed again.
+// It returns the listeners on addresses that aren't in the configuration
+// anymore, for the caller to close them
+func (s *Servers) updateListeners(conf *config.Config) ([]listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stale := make(map[string]listener, len(s.listeners))
+	for key, l := range s.listeners {
+		stale[key] = l
 	}
+	added := make(map[string]listener)
+	var (
+		removed []listener
+		err     error
+	)
 
 	// listen
-	if config.Server6 != nil {
-		serverLogger.Println("Starting DHCPv6 server")
-		for _, addr := range config.Server6.Addresses {
+	if conf.Server6 != nil {
+		if len(s.listeners) == 0 {
+			s.Log.Println("Starting DHCPv6 server")
+		}
+		for _, addr := range conf.Server6.Addresses {
+			key := listenKey(6, &addr)
+			if _, ok := s.listeners[key]; ok {
+				delete(stale, key)
+				continue
+			}
 			var l6 *listener6
-			l6, err = listen6(serverLogger, &addr)
+			if conn, ok := s.conns[key]; ok {
+				delete(s.conns, key)
+				l6, err = newListener6(s.Log, conn, &addr)
+			} else {
+				l6, err = listen6(s.Log, &addr)
+			}
 			if err != nil {
 				goto cleanup
 			}
-			l6.handlers = handlers6
-			srv.listeners = append(srv.listeners, l6)
-			go func() {
-				srv.errors <- l6.Serve()
-			}()
+			l6.chain = &s.chain
+			l6.pool = newWorkerPool(conf.Server6.Workers, s.Log.WithField("listener", key))
+			l6.batch = conf.Server6.Batch
+			l6.timeout = conf.Server6.Timeout
+			l6.drops = &s.drops
+			added[key] = l6
 		}
 	}
 
-	if config.Server4 != nil {
-		serverLogger.Println("Starting DHCPv4 server")
-		for _, addr := range config.Server4.Addresses {
+	if conf.Server4 != nil {
+		if len(s.listeners) == 0 {
+			s.Log.Println("Starting DHCPv4 server")
+		}
+		for _, addr := range conf.Server4.Addresses {
+			key := listenKey(4, &addr)
+			if _, ok := s.listeners[key]; ok {
+				delete(stale, key)
+				continue
+			}
 			var l4 *listener4
-			l4, err = listen4(serverLogger, &addr)
+			if conn, ok := s.conns[key]; ok {
+				delete(s.conns, key)
+				l4, err = newListener4(s.Log, conn, &addr)
+			} else {
+				l4, err = listen4(s.Log, &addr)
+			}
 			if err != nil {
 				goto cleanup
 			}
-			l4.handlers = handlers4
-			srv.listeners = append(srv.listeners, l4)
-			go func() {
-				srv.errors <- l4.Serve()
-			}()
+			l4.chain = &s.chain
+			l4.pool = newWorkerPool(conf.Server4.Workers, s.Log.WithField("listener", key))
+			l4.batch = conf.Server4.Batch
+			l4.timeout = conf.Server4.Timeout
+			l4.drops = &s.drops
+			added[key] = l4
 		}
 	}
 
-	return &srv, nil
+	for key, l := range added {
+		s.listeners[key] = l
+		s.serving.Add(1)
+		go s.serve(l)
+	}
+	for key, l := range stale {
+		delete(s.listeners, key)
+		removed = append(removed, l)
+	}
+	return removed, nil
 
 cleanup:
-	srv.Close()
+	for _, l := range added {
+		l.Close()
+	}
 	return nil, err
 }
 
-// Wait waits until the end of the execution of the server.
+// serve runs a listener, reporting its failure to Wait
+func (s *Servers) serve(l listener) {
+	defer s.serving.Done()
+	if err := l.Serve(); err != nil {
+		select {
+		case s.errors <- err:
+		default:
+			// Another listener already failed
+		}
+	}
+}
+
+// Reload applies a new configuration to the running server: the plugins are
+// loaded anew, reusing the instances whose arguments didn't change, and listeners are opened and closed to match the configured
+// addresses. Requests received from then on are handled by the new plugins,
+// the old ones are closed once the requests they're handling are answered.
+// The worker settings only apply to the listeners opened by the reload.
+// If the new configuration can't be applied, an error is returned and the
+// server keeps running with the current one
+func (s *Servers) Reload(conf *config.Config) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.Log.Print("Reloading configuration")
+	pluginChain, err := s.registry.Reload(s.Log, conf, s.chain.get().Chain)
+	if err != nil {
+		return err
+	}
+	removed, err := s.updateListeners(conf)
+	if err != nil {
+		pluginChain.Close()
+		return err
+	}
+	old := s.chain.swap(&chain{Chain: pluginChain})
+	for _, l := range removed {
+		l.Close()
+	}
+
+	s.retiring.Add(1)
+	go func() {
+		defer s.retiring.Done()
+		old.inflight.Wait()
+		if err := old.Close(); err != nil {
+			s.Log.Errorf("Could not close the previous plugins: %v", err)
+		}
+	}()
+	s.Log.Print("Configuration reloaded")
+	return nil
+}
+
+// Wait waits until the end of the execution of the server, when a listener
+// fails or the server is shut down. It returns the error of the listener, if any.
 func (s *Servers) Wait() error {
 	s.Log.Debug("Waiting")
-	err := <-s.errors
+	var err error
+	select {
+	case err = <-s.errors:
+	case <-s.done:
+	}
 	s.Close()
 	return err
 }
 
 // Close closes all listening connections
 func (s *Servers) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, srv := range s.listeners {
 		if srv != nil {
 			srv.Close()
 		}
 	}
 }
+
+// Shutdown gracefully stops the server: the listeners stop receiving
+// packets, the packets being handled are given until the context is done to
+// be answered, then the plugins are closed. It returns the context's error
+// if the packets being handled didn't make it in time, or the first error
+// encountered while closing plugins
+func (s *Servers) Shutdown(ctx context.Context) error {
+	s.Close()
+
+	current := s.chain.get()
+	drained := make(chan struct{})
+	go func() {
+		// Listeners may still be handing a request to the chain until they
+		// stop serving
+		s.serving.Wait()
+		current.inflight.Wait()
+		s.retiring.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.Log.Warningf("Gave up waiting for in-flight requests: %v", err)
+	}
+
+	if cerr := current.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/insei/coredhcp/handler"
+	"github.com/insei/coredhcp/logger"
+	"github.com/insei/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testsLogger = logger.GetLogger("tests")
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+// testInstances records the instances of the test plugin still open, by
+// argument
+type testInstances struct {
+	sync.Mutex
+	open map[string]bool
+}
+
+func (ti *testInstances) isOpen(arg string) bool {
+	ti.Lock()
+	defer ti.Unlock()
+	return ti.open[arg]
+}
+
+// registerTestPlugin registers a DHCPv4 plugin recording its instances in ti,
+// and failing to set up when given the "fail" argument
+func registerTestPlugin(t *testing.T, ti *testInstances) {
+	ti.open = make(map[string]bool)
+	plugins.RegisteredPlugins["test_instances"] = &plugins.Plugin{
+		Name: "test_instances",
+		Init4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
+			if args[0] == "fail" {
+				return nil, nil, errors.New("setup failed")
+			}
+			ti.Lock()
+			defer ti.Unlock()
+			ti.open[args[0]] = true
+			h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+			return h, closeFunc(func() error {
+				ti.Lock()
+				defer ti.Unlock()
+				delete(ti.open, args[0])
+				return nil
+			}), nil
+		},
+	}
+	t.Cleanup(func() { delete(plugins.RegisteredPlugins, "test_instances") })
+}
+
+func testConfig(port int, arg string) *config.Config {
+	return &config.Config{
+		Name: "test",
+		Server4: &config.ServerConfig{
+			Addresses: []net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: port}},
+			Plugins:   []config.PluginConfig{{Name: "test_instances", Args: []string{arg}}},
+		},
+	}
+}
+
+func TestReload(t *testing.T) {
+	var ti testInstances
+	registerTestPlugin(t, &ti)
+
+	srv, err := Start(testsLogger, testConfig(0, "first"))
+	require.NoError(t, err)
+	assert.True(t, ti.isOpen("first"))
+	require.Len(t, srv.listeners, 1)
+
+	// A configuration failing to load leaves the server untouched
+	assert.Error(t, srv.Reload(testConfig(0, "fail")))
+	assert.True(t, ti.isOpen("first"), "Current plugins closed by a failed reload")
+
+	require.NoError(t, srv.Reload(testConfig(0, "second")))
+	assert.True(t, ti.isOpen("second"))
+	assert.Eventually(t, func() bool { return !ti.isOpen("first") }, time.Second, 10*time.Millisecond,
+		"Previous plugins were not closed")
+	require.Len(t, srv.listeners, 1)
+
+	// Listeners follow the configured addresses
+	require.NoError(t, srv.Reload(testConfig(0, "third")))
+	conf := testConfig(0, "third")
+	conf.Server4 = nil
+	conf.Server6 = &config.ServerConfig{}
+	require.NoError(t, srv.Reload(conf))
+	assert.Empty(t, srv.listeners)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.Empty(t, ti.open, "Plugins left open after shutdown")
+	assert.NoError(t, srv.Wait())
+}
+
+func TestStartWithRegistry(t *testing.T) {
+	var ti testInstances
+	ti.open = make(map[string]bool)
+	registry := plugins.NewRegistry()
+	require.NoError(t, registry.Register(&plugins.Plugin{
+		Name: "test_instances",
+		Init4: func(_ logrus.FieldLogger, args ...string) (handler.Handler4, io.Closer, error) {
+			ti.Lock()
+			defer ti.Unlock()
+			ti.open[args[0]] = true
+			h := func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }
+			return h, closeFunc(func() error { return nil }), nil
+		},
+	}))
+
+	// The plugin is only in the registry
+	_, err := Start(testsLogger, testConfig(0, "first"))
+	assert.Error(t, err)
+
+	srv, err := StartWithRegistry(testsLogger, testConfig(0, "first"), registry)
+	require.NoError(t, err)
+	assert.True(t, ti.isOpen("first"))
+	require.NoError(t, srv.Reload(testConfig(0, "second")), "Reload didn't use the registry")
+	assert.True(t, ti.isOpen("second"))
+	require.NoError(t, srv.Shutdown(context.Background()))
+}
@@ -0,0 +1,121 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/sirupsen/logrus"
+)
+
+// dropWarnInterval rate-limits the warnings about dropped datagrams
+const dropWarnInterval = 10 * time.Second
+
+// job is a received datagram waiting to be handled by a worker
+type job struct {
+	// c is the chain acquired to handle the datagram
+	c   *chain
+	buf []byte
+	// handle handles the datagram with c, and gives buf back to bufpool
+	handle func()
+}
+
+// workerPool handles the datagrams received on a listener with a bounded
+// number of goroutines, queueing at most a bounded number of datagrams
+type workerPool struct {
+	// dropped is accessed atomically, it comes first to be 64-bit aligned
+	dropped uint64
+	jobs    chan job
+	workers int
+	policy  config.DropPolicy
+	wg      sync.WaitGroup
+	log     logrus.FieldLogger
+	// lastWarn is only used by the goroutine submitting jobs
+	lastWarn time.Time
+}
+
+func newWorkerPool(conf config.WorkerConfig, log logrus.FieldLogger) *workerPool {
+	workers, queue := conf.Workers, conf.Queue
+	if workers <= 0 {
+		workers = config.DefaultWorkers
+	}
+	if queue <= 0 {
+		queue = config.DefaultQueue
+	}
+	return &workerPool{
+		jobs:    make(chan job, queue),
+		workers: workers,
+		policy:  conf.Drop,
+		log:     log,
+	}
+}
+
+// start starts the workers
+func (p *workerPool) start() {
+	p.wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for j := range p.jobs {
+				j.handle()
+				j.c.release()
+			}
+		}()
+	}
+}
+
+// stop lets the workers exit once the queued jobs are handled, and waits for
+// them. No job may be submitted afterwards
+func (p *workerPool) stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// submit queues a job, dropping a job according to the policy if the queue is
+// full. It must not be called concurrently
+func (p *workerPool) submit(j job) {
+	select {
+	case p.jobs <- j:
+		return
+	default:
+	}
+	if p.policy != config.DropOldest {
+		p.drop(j)
+		return
+	}
+	for {
+		select {
+		case old := <-p.jobs:
+			p.drop(old)
+		default:
+			// The workers emptied the queue in the meantime
+		}
+		select {
+		case p.jobs <- j:
+			return
+		default:
+		}
+	}
+}
+
+// drop releases the resources held by a job without handling it
+func (p *workerPool) drop(j job) {
+	putBuffer(j.buf)
+	j.c.release()
+	n := atomic.AddUint64(&p.dropped, 1)
+	if now := time.Now(); now.Sub(p.lastWarn) >= dropWarnInterval {
+		p.lastWarn = now
+		p.log.Warningf("Queue full, %d datagrams dropped so far", n)
+	}
+}
+
+// droppedCount returns the number of datagrams dropped because the queue was
+// full
+func (p *workerPool) droppedCount() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
@@ -0,0 +1,65 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/insei/coredhcp/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolDrop(t *testing.T) {
+	for _, tt := range []struct {
+		policy config.DropPolicy
+		kept   []int
+	}{
+		{config.DropNewest, []int{0, 1}},
+		{config.DropOldest, []int{1, 2}},
+	} {
+		// The workers aren't started, so that the queue fills up
+		p := newWorkerPool(config.WorkerConfig{Workers: 1, Queue: 2, Drop: tt.policy}, testsLogger)
+		c := &chain{}
+		var handled []int
+		for i := 0; i < 3; i++ {
+			i := i
+			c.inflight.Add(1)
+			p.submit(job{c: c, buf: make([]byte, MaxDatagram), handle: func() { handled = append(handled, i) }})
+		}
+		assert.Equal(t, uint64(1), p.droppedCount())
+
+		p.start()
+		p.stop()
+		c.inflight.Wait()
+		assert.Equal(t, tt.kept, handled, "Policy %v", tt.policy)
+	}
+}
+
+func TestWorkerPoolStop(t *testing.T) {
+	p := newWorkerPool(config.WorkerConfig{Workers: 1}, testsLogger)
+	p.start()
+	c := &chain{}
+	c.inflight.Add(1)
+	started, release := make(chan struct{}), make(chan struct{})
+	p.submit(job{c: c, buf: make([]byte, MaxDatagram), handle: func() {
+		close(started)
+		<-release
+	}})
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Pool stopped while a job was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+}